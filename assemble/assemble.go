@@ -23,14 +23,162 @@ along with rasm16.  If not, see <http://www.gnu.org/licenses/>.
 package assemble
 
 import (
-	"errors"
 	"fmt"
-	"strconv"
+	"os"
+	"time"
 )
 
 // -----------------------------------------------------------------------------
 
-const DEBUG bool = true
+var DEBUG bool = true
+
+// Assembler version.
+const version string = "1.0.0 alpha"
+
+// Whether to output all labels and their addresses after a successful build.
+var PrintSymbols bool = false
+
+// Include files read during the most recent assembly, including those of a
+// failed assembly up to the point of failure.
+var IncNames []string
+
+// Options of a single assembly. The package variables of the same names hold
+// the options of assemblies started through Raw and the other entry points.
+type Options struct {
+	Target             string // Target memory profile name.
+	CommentChar        string
+	DataDlm            string
+	InstrDlm           string
+	SrcLabelMinLen     int // Minimum number of characters in a source label.
+	HeaderVersion      byte
+	EntryLabel         string
+	ExplicitOffset     bool // Whether the program offset was given rather than defaulted.
+	WarningsAsErrors   bool
+	CheckJumpTargets   bool
+	WarnSharedLabels   bool
+	PrintSymbols       bool
+	BuildListing       bool
+	ListCycles         bool
+	BuildXref          bool
+	BuildRelocTable    bool
+	MaxIncDepth        int
+	MaxExpandedLines   int
+	IncDirs            []string // Include directories, searched in order.
+	NamespaceIncConsts bool
+	Charset            Charset // Charset table used by charset data directives, set by LoadCharset.
+	PadSize            int
+	BuildInfo          string
+}
+
+// State of a single assembly. Keeping it out of package variables lets several
+// assemblies run concurrently.
+type assembly struct {
+	opts         Options
+	target       targetProfile
+	consts       map[string]string // Preprocessor constants defined so far.
+	incNames     []string          // Include files read so far.
+	exports      map[string]string // Exported labels by name without namespace.
+	object       bool              // Whether labels may be left for the linker.
+	warnings     []AssembleError
+	listing      []string
+	xref         []string
+	relocOffsets []uint16
+	timings      []phaseTiming
+}
+
+// -----------------------------------------------------------------------------
+
+// Version returns the assembler version.
+func Version() string {
+	return version
+}
+
+// -----------------------------------------------------------------------------
+
+// DefaultOptions returns the default assembly options, regardless of the
+// package variables.
+func DefaultOptions() Options {
+	return Options{
+		Target:           DefaultTargetName,
+		CommentChar:      defaultCommentChar,
+		DataDlm:          defaultDataDlm,
+		InstrDlm:         defaultInstrDlm,
+		SrcLabelMinLen:   defaultSrcLabelMinLen,
+		HeaderVersion:    headerVersionLegacy,
+		MaxIncDepth:      defaultMaxIncDepth,
+		MaxExpandedLines: defaultMaxExpandedLines,
+		Charset:          builtinCharsets[defaultCharsetName],
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// currentOptions returns the assembly options held by the package variables.
+func currentOptions() Options {
+	return Options{
+		Target:             Target,
+		CommentChar:        CommentChar,
+		DataDlm:            DataDlm,
+		InstrDlm:           InstrDlm,
+		SrcLabelMinLen:     SrcLabelMinLen,
+		HeaderVersion:      HeaderVersion,
+		EntryLabel:         EntryLabel,
+		ExplicitOffset:     ExplicitOffset,
+		WarningsAsErrors:   WarningsAsErrors,
+		CheckJumpTargets:   CheckJumpTargets,
+		WarnSharedLabels:   WarnSharedLabels,
+		PrintSymbols:       PrintSymbols,
+		BuildListing:       BuildListing,
+		ListCycles:         ListCycles,
+		BuildXref:          BuildXref,
+		BuildRelocTable:    BuildRelocTable,
+		MaxIncDepth:        MaxIncDepth,
+		MaxExpandedLines:   MaxExpandedLines,
+		IncDirs:            IncDirs,
+		NamespaceIncConsts: NamespaceIncConsts,
+		Charset:            activeCharset,
+		PadSize:            PadSize,
+		BuildInfo:          BuildInfo,
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// validateOptions checks whether assembly options are usable together.
+func validateOptions(opts Options) error {
+	_, err := getTargetProfile(opts.Target)
+	if err != nil {
+		return err
+	}
+
+	err = validateHeaderVersion(opts.HeaderVersion)
+	if err != nil {
+		return err
+	}
+
+	err = validateInstrDlm(opts.InstrDlm, opts.CommentChar)
+	if err != nil {
+		return err
+	}
+
+	err = validateSrcLabelMinLen(opts.SrcLabelMinLen)
+	if err != nil {
+		return err
+	}
+
+	return validateDataDlm(opts.DataDlm, opts.CommentChar, opts.InstrDlm)
+}
+
+// -----------------------------------------------------------------------------
+
+// newAssembly creates the state for a new assembly using the given options,
+// starting out with the built-in preprocessor constants of its target memory
+// profile only.
+func newAssembly(opts Options) *assembly {
+	target := targetProfiles[opts.Target]
+
+	return &assembly{opts: opts, target: target, consts: mergeConsts(target.defaultConsts)}
+}
 
 // -----------------------------------------------------------------------------
 
@@ -42,99 +190,392 @@ const DEBUG bool = true
 //      Expand constants
 //      Namespacing
 //      Includes
+//      Apply pragmas
+//      Resolve symbol directives
 //      Validate labels
 // Convert to struct
+//      Check orphaned labels
 // Process struct
 //      Unalias mnemonics
+//      Apply leading origin
 //      Translate data strings to hex
+//      Translate data decimals to hex
 //      Expand data null repeats
 //      Validate mnemonics
-//      Validate data directives
+//      Validate operand widths
 //      Calculate addresses
+//      Resolve program size
+//      Check shared label addresses (optional)
+//      Check jump targets (optional)
 //      Expand labels
+//      Validate data directives
 //      Validate operands
 // Convert to binary
 func Raw(rawSrcLines []string, srcName string, programOffset uint16) ([]byte, error) {
-	var err error
+	return RawFiles([][]string{rawSrcLines}, []string{srcName}, programOffset)
+}
 
-	printSrc("", rawSrcLines)
+// -----------------------------------------------------------------------------
 
-	rawSrcLines = cleanSrc(rawSrcLines)
-	printSrc("Removed comments and extraneous whitespace", rawSrcLines)
+// RawFiles assembles several source files together into one binary, in the
+// given order, like Raw does for a single source file. Labels can be shared
+// between the source files using symbol directives.
+func RawFiles(rawSrcs [][]string, srcNames []string, programOffset uint16) ([]byte, error) {
+	asm := newAssembly(currentOptions())
+
+	bin, err := asm.assembleFiles(rawSrcs, srcNames, programOffset)
 
-	rawSrcLines, err = expandConsts(rawSrcLines)
+	if PrintTiming {
+		asm.printTimings()
+	}
+
+	Warnings = asm.warnings
+	IncNames = asm.incNames
+	Listing = asm.listing
+	Xref = asm.xref
+	RelocOffsets = asm.relocOffsets
+
+	return bin, err
+}
+
+// -----------------------------------------------------------------------------
+
+// assembleFiles runs the complete assembly process for RawFiles, keeping
+// warnings, listing and relocation table in the assembly state.
+func (asm *assembly) assembleFiles(rawSrcs [][]string, srcNames []string, programOffset uint16) ([]byte, error) {
+	srcLines, programOffset, labelAddresses, err := asm.buildValidatedSrc(rawSrcs, srcNames, programOffset)
 	if err != nil {
 		return nil, err
 	}
-	printSrc("Expanded constants", rawSrcLines)
 
-	rawSrcLines = addSrcLabelNamespaces(rawSrcLines, srcName)
-	printSrc("Added label namespaces", rawSrcLines)
+	entryPoint, err := asm.resolveEntryPoint(labelAddresses, srcNames[0], programOffset)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
 
-	rawSrcLines, err = addIncludes(rawSrcLines)
+	srcLines = asm.buildBinSrcLines(srcLines)
+	printStructSrc("Built structured binary", srcLines)
+
+	if asm.opts.BuildListing {
+		asm.listing = asm.buildListing(srcLines)
+	}
+
+	if asm.opts.BuildXref {
+		asm.xref = buildXref(srcLines)
+	}
+
+	if asm.opts.BuildRelocTable {
+		asm.relocOffsets, err = buildRelocTable(srcLines, programOffset)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	bin, err := asm.buildBin(srcLines, programOffset, entryPoint)
 	if err != nil {
 		return nil, err
 	}
-	printSrc("Added include files", rawSrcLines)
+	printBin("Built final binary", bin)
+
+	asm.addTiming("Binary build", start)
+
+	err = asm.upgradeWarnings()
+	if err != nil {
+		return nil, err
+	}
+
+	if asm.opts.PrintSymbols {
+		if isBanked(srcLines) {
+			printSymbols(labelAddresses, getLabelBanks(srcLines))
+		} else {
+			printSymbols(labelAddresses, nil)
+		}
+	}
+
+	return bin, nil
+}
+
+// -----------------------------------------------------------------------------
+
+// ValidateSource runs all assembly steps up to and including operand
+// validation without building a binary, and returns every warning followed by
+// the error or errors that stopped the assembly, if any. Errors not tied to a
+// line of source code, such as a missing include file, have line number 0.
+func ValidateSource(rawSrcLines []string, srcName string) []AssembleError {
+	asm := newAssembly(currentOptions())
+
+	_, _, _, err := asm.buildValidatedSrc([][]string{rawSrcLines}, []string{srcName}, 0)
+
+	diagnostics := asm.warnings
+
+	switch assembleErr := err.(type) {
+	case nil:
+	case AssembleError:
+		diagnostics = append(diagnostics, assembleErr)
+	case AssembleErrors:
+		diagnostics = append(diagnostics, assembleErr...)
+	default:
+		diagnostics = append(diagnostics, AssembleError{Message: err.Error()})
+	}
+
+	return diagnostics
+}
+
+// -----------------------------------------------------------------------------
+
+// StructSrc runs all assembly steps up to and including address calculation and
+// returns the resulting structured source code in a stable, tab-separated
+// format, one line per instruction or directive: origin, address (prefixed with
+// the bank for banked source code), labels, mnemonic and operands or data.
+// Warnings found along the way are published like Raw does.
+func StructSrc(rawSrcs [][]string, srcNames []string, programOffset uint16) ([]string, error) {
+	asm := newAssembly(currentOptions())
+	defer func() { Warnings = asm.warnings }()
+
+	srcLines, _, err := asm.buildAddressedSrc(rawSrcs, srcNames, programOffset)
+	if err != nil {
+		return nil, err
+	}
+
+	return formatStructSrc(srcLines), nil
+}
+
+// -----------------------------------------------------------------------------
+
+// buildValidatedSrc runs all assembly steps up to and including operand
+// validation, turning raw source code from one or more source files into
+// structured source code ready to be converted to binary. The program offset
+// and label addresses are returned as well.
+func (asm *assembly) buildValidatedSrc(rawSrcs [][]string, srcNames []string, programOffset uint16) ([]srcLine, uint16, map[string]int, error) {
+	srcLines, programOffset, err := asm.buildAddressedSrc(rawSrcs, srcNames, programOffset)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	start := time.Now()
+
+	labelAddresses := getLabelAddresses(srcLines)
+
+	if DEBUG {
+		fmt.Fprintln(os.Stderr, "Found label addresses", labelAddresses)
+	}
+
+	if asm.opts.CheckJumpTargets {
+		asm.checkJumpTargets(srcLines, labelAddresses)
+	}
+
+	srcLines, err = asm.expandLabels(srcLines, labelAddresses)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	printStructSrc("Expanded labels", srcLines)
+
+	asm.addTiming("Label expansion", start)
+	start = time.Now()
+
+	_, err = asm.validateDataDirectives(srcLines)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	_, err = asm.validateOps(srcLines)
+	if err != nil {
+		return nil, 0, nil, err
+	}
 
-	hasDupeSrcLabels, srcLabel, lineNum := hasDupeSrcLabels(rawSrcLines)
+	asm.addTiming("Validation", start)
+
+	return srcLines, programOffset, labelAddresses, nil
+}
+
+// -----------------------------------------------------------------------------
+
+// buildAddressedSrc runs all assembly steps up to and including address
+// calculation, turning raw source code from one or more source files into
+// structured source code with final addresses but unexpanded labels. The
+// program offset is returned as well, since a leading origin directive may
+// change it.
+func (asm *assembly) buildAddressedSrc(rawSrcs [][]string, srcNames []string, programOffset uint16) ([]srcLine, uint16, error) {
+	var rawSrcLines []string
+	var origins []srcOrigin
+
+	err := validateOptions(asm.opts)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for srcNum, srcName := range srcNames {
+		var incName string
+		if srcNum > 0 {
+			incName = srcName
+		}
+
+		srcRawLines, srcOrigins, err := asm.processSrc(rawSrcs[srcNum], srcName, incName)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		rawSrcLines = append(rawSrcLines, srcRawLines...)
+		origins = append(origins, srcOrigins...)
+	}
+
+	start := time.Now()
+
+	rawSrcLines, programOffset, hasOffsetPragma, err := applyPragmas(rawSrcLines, origins, programOffset, asm.opts.ExplicitOffset)
+	if err != nil {
+		return nil, 0, err
+	}
+	printSrc("Applied pragmas", rawSrcLines)
+
+	rawSrcLines, err = asm.resolveSymbolDirectives(rawSrcLines, origins)
+	if err != nil {
+		return nil, 0, err
+	}
+	printSrc("Resolved symbol directives", rawSrcLines)
+
+	rawSrcLines, err = asm.resolveEquDirectives(rawSrcLines, origins)
+	if err != nil {
+		return nil, 0, err
+	}
+	printSrc("Resolved value directives", rawSrcLines)
+
+	hasDupeSrcLabels, srcLabel, lineNum, firstLineNum := asm.hasDupeSrcLabels(rawSrcLines)
 	if hasDupeSrcLabels {
-		return nil, errors.New("Duplicate label found on line " + strconv.Itoa(lineNum+1) + ": " + srcLabel)
+		return nil, 0, newAssembleError(origins[lineNum], srcLabel, "Duplicate label "+srcLabel+" on "+describeOrigin(origins[lineNum])+" (first defined on "+describeOrigin(origins[firstLineNum])+")")
 	}
 
-	srcLines := buildStructSrc(rawSrcLines)
+	srcLines := asm.buildStructSrc(rawSrcLines, origins)
 	printStructSrc("Built structured source", srcLines)
 
+	labelOrigins := asm.getLabelOrigins(rawSrcLines, origins)
+
+	asm.warnOrphanedLabels(srcLines, labelOrigins)
+
 	srcLines = unaliasMnemonics(srcLines)
 	printStructSrc("Unaliased mnemonics", srcLines)
 
-	srcLines = convDataStringsToHex(srcLines)
+	srcLines, programOffset, err = applyLeadingOrg(srcLines, programOffset, asm.opts.ExplicitOffset || hasOffsetPragma)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	srcLines, err = asm.convDataStringsToHex(srcLines)
+	if err != nil {
+		return nil, 0, err
+	}
 	printStructSrc("Converted data strings to hex", srcLines)
 
-	srcLines, err = expandDataNullRepeats(srcLines)
+	srcLines, err = asm.convDataDecimalsToHex(srcLines)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
+	}
+	printStructSrc("Converted data decimals to hex", srcLines)
+
+	srcLines, err = asm.expandDataNullRepeats(srcLines)
+	if err != nil {
+		return nil, 0, err
 	}
 	printStructSrc("Expanded data null repeats", srcLines)
 
 	_, err = validateMnemonics(srcLines)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
-	_, err = validateDataDirectives(srcLines)
+	_, err = validateOpWidths(srcLines)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
-	srcLines, err = calcAddresses(srcLines, programOffset)
+	asm.addTiming("Struct build", start)
+	start = time.Now()
+
+	srcLines, err = asm.calcAddresses(srcLines, programOffset)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	printStructSrc("Calculated addresses", srcLines)
 
-	labelAddresses := getLabelAddresses(srcLines)
+	srcLines, err = asm.resolveSizeSymbols(srcLines)
+	if err != nil {
+		return nil, 0, err
+	}
+	printStructSrc("Resolved program size", srcLines)
 
-	if DEBUG {
-		fmt.Println("Found label addresses", labelAddresses)
+	if asm.opts.WarnSharedLabels {
+		asm.warnSharedLabelAddresses(srcLines, labelOrigins)
+	}
+
+	asm.addTiming("Address calculation", start)
+
+	return srcLines, programOffset, nil
+}
+
+// -----------------------------------------------------------------------------
+
+// processSrc runs the source processing steps for a single source file,
+// including its include files. Origins of the source file's own lines use the
+// given include name, empty for the main source file.
+func (asm *assembly) processSrc(rawSrcLines []string, srcName string, incName string) ([]string, []srcOrigin, error) {
+	var err error
+
+	printSrc("", rawSrcLines)
+
+	origins := newSrcOrigins(incName, rawSrcLines)
+
+	start := time.Now()
+
+	rawSrcLines = asm.cleanSrc(rawSrcLines)
+	printSrc("Removed comments and extraneous whitespace", rawSrcLines)
+
+	rawSrcLines, err = asm.joinContinuedLines(rawSrcLines, origins)
+	if err != nil {
+		return nil, nil, err
 	}
+	printSrc("Joined continued lines", rawSrcLines)
+
+	rawSrcLines, origins = asm.splitInlineLabels(rawSrcLines, origins)
+	printSrc("Split inline labels", rawSrcLines)
+
+	asm.addTiming("Clean-up", start)
+	start = time.Now()
 
-	srcLines, err = expandLabels(srcLines, labelAddresses)
+	rawSrcLines, err = asm.expandConsts(rawSrcLines, origins, srcName)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	printStructSrc("Expanded labels", srcLines)
+	printSrc("Expanded constants", rawSrcLines)
 
-	_, err = validateOps(srcLines)
+	asm.addTiming("Constant expansion", start)
+	start = time.Now()
+
+	rawSrcLines = asm.addSrcLabelNamespaces(rawSrcLines, srcName)
+	printSrc("Added label namespaces", rawSrcLines)
+
+	asm.addTiming("Namespacing", start)
+	start = time.Now()
+
+	rawSrcLines, origins, err = asm.addIncludes(rawSrcLines, origins, []string{srcName})
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	printSrc("Added include files", rawSrcLines)
 
-	srcLines = buildBinSrcLines(srcLines)
-	printStructSrc("Built structured binary", srcLines)
+	asm.addTiming("Include processing", start)
 
-	bin := buildBin(srcLines, programOffset)
-	printBin("Built final binary", bin)
+	if asm.opts.NamespaceIncConsts {
+		start = time.Now()
 
-	return bin, nil
+		rawSrcLines, err = asm.expandDeferredConsts(rawSrcLines, origins)
+		if err != nil {
+			return nil, nil, err
+		}
+		printSrc("Expanded namespaced preprocessor constants", rawSrcLines)
+
+		asm.addTiming("Constant expansion", start)
+	}
+
+	return rawSrcLines, origins, nil
 }
@@ -0,0 +1,1267 @@
+/*
+Copyright 2018-2019 Juan Irming
+
+This file is part of rasm16.
+
+rasm16 is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+rasm16 is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with rasm16.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package assemble
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"rasm/file"
+	"strings"
+	"testing"
+)
+
+// -----------------------------------------------------------------------------
+
+// Test programs, besides the self-test program.
+var testPrograms = []testProgram{
+	// Labels used before their definition resolve identically to labels used
+	// after it, including on labelled lines referencing labels themselves.
+	{
+		srcName: "selftest_refs.rasm",
+		offset:  0x2000,
+		src: []string{
+			"first",
+			"    CO   $third,third",
+			"second",
+			"    JM   $third",
+			"third",
+			"    JM   $third",
+			"    CO   $first,*second",
+			"    $16  first,third",
+			"    JM   ~second",
+		},
+		bin: []byte{
+			0x10, 0x20, 0x08, 0x20, 0x08, // CO
+			0xE8, 0x20, 0x08, // JM
+			0xE8, 0x20, 0x08, // JM
+			0x11, 0x20, 0x00, 0x20, 0x05, // CO
+			0x20, 0x00, 0x20, 0x08, // $16
+			0xEE, 0xFF, 0xEE, // JM
+		},
+	},
+
+	// Stacked labels share the address of the line they precede.
+	{
+		srcName: "selftest_stacked.rasm",
+		offset:  0x4000,
+		src: []string{
+			"alpha",
+			"bravo",
+			"    JM   $alpha",
+			"    JM   $bravo",
+		},
+		bin: []byte{
+			0xE8, 0x40, 0x00, // JM
+			0xE8, 0x40, 0x00, // JM
+		},
+	},
+
+	// Labels followed by nothing but empty lines attach to the next line, or
+	// resolve to the end address of the program at the end of the source code.
+	{
+		srcName: "selftest_trailing.rasm",
+		offset:  0x5000,
+		src: []string{
+			"    JM   $finish",
+			"middle",
+			"",
+			"    JM   $middle",
+			"finish",
+			"",
+		},
+		bin: []byte{
+			0xE8, 0x50, 0x06, // JM
+			0xE8, 0x50, 0x03, // JM
+		},
+	},
+
+	// Labels that end up without a line to attach to are reported.
+	{
+		srcName: "selftest_orphan.rasm",
+		offset:  0x6000,
+		src: []string{
+			"orphan",
+			"    ;",
+			"    NO",
+		},
+		bin: []byte{
+			0x00, // NO
+		},
+		warnings: []string{
+			"Label selftest_orphan.orphan is not attached to any instruction or data",
+		},
+	},
+
+	// Preprocessor constants with overlapping names expand to their own values.
+	{
+		srcName: "selftest_consts.rasm",
+		offset:  0x3000,
+		src: []string{
+			"[PORT]  FFE0",
+			"[PORTA] FFE2",
+			"    CO   $1,[PORTA]",
+			"    CO   $2,[PORT]",
+		},
+		bin: []byte{
+			0x10, 0x00, 0x01, 0xFF, 0xE2, // CO
+			0x10, 0x00, 0x02, 0xFF, 0xE0, // CO
+		},
+	},
+
+	// Whitespace around data delimiters is ignored.
+	{
+		srcName: "selftest_spaces.rasm",
+		offset:  0x7000,
+		src: []string{
+			"    $16  12, 34 ,56",
+			"    $8   1 , 2,3",
+		},
+		bin: []byte{
+			0x00, 0x12, 0x00, 0x34, 0x00, 0x56, // $16
+			0x01, 0x02, 0x03, // $8
+		},
+	},
+
+	// String preprocessor constants expand into string data directives,
+	// keeping comment characters and whitespace within the quotes.
+	{
+		srcName: "selftest_strconst.rasm",
+		offset:  0x7800,
+		src: []string{
+			"[GREETING] \"Hi,  #1\" # Greeting",
+			"    $8   [GREETING]",
+			"    $8   [GREETING] # Again",
+		},
+		bin: []byte{
+			0x22, 0x48, 0x69, 0x2C, 0x20, 0x20, 0x23, 0x31, 0x22, // $8
+			0x22, 0x48, 0x69, 0x2C, 0x20, 0x20, 0x23, 0x31, 0x22, // $8
+		},
+	},
+
+	// Preprocessor constant definitions can derive values arithmetically from
+	// other constants.
+	{
+		srcName: "selftest_constexpr.rasm",
+		offset:  0x7C00,
+		src: []string{
+			"[BASE]  1000",
+			"[END]   [BASE] + 10*2 - 8/4",
+			"    CO   [BASE],[END]",
+		},
+		bin: []byte{
+			0x12, 0x10, 0x00, 0x10, 0x1E, // CO
+		},
+	},
+
+	// Preprocessor constant definitions that are not purely numeric, such as
+	// label differences, are still substituted textually.
+	{
+		srcName: "selftest_constlabels.rasm",
+		offset:  0x7D00,
+		src: []string{
+			"[SIZE]  table_end-table_start",
+			"table_start",
+			"    $8   01,02,03",
+			"table_end",
+			"    $16  [SIZE]",
+			"    $8   [SIZE]",
+		},
+		bin: []byte{
+			0x01, 0x02, 0x03, // $8
+			0x00, 0x03, // $16
+			0x03, // $8
+		},
+	},
+
+	// Expressions on preprocessor constants take the width of the data
+	// directive they are used in.
+	{
+		srcName: "selftest_exprwidth.rasm",
+		offset:  0x7A00,
+		src: []string{
+			"[C]     41",
+			"    $8   [C]+1,[C]*2",
+			"    $16  [C]+1",
+			"    $8   [C]+1 ; $16 [C]+1",
+		},
+		bin: []byte{
+			0x42, 0x82, // $8
+			0x00, 0x42, // $16
+			0x42,       // $8
+			0x00, 0x42, // $16
+		},
+	},
+
+	// Several preprocessor constants on one line expand separately, and
+	// brackets within values are not mistaken for constants.
+	{
+		srcName: "selftest_brackets.rasm",
+		offset:  0x7E00,
+		src: []string{
+			"[OPEN]  \"[x]\"",
+			"[ONE]   0001",
+			"[TWO]   0002",
+			"    CO   [ONE],[TWO]",
+			"    $8   [OPEN]",
+		},
+		bin: []byte{
+			0x12, 0x00, 0x01, 0x00, 0x02, // CO
+			0x22, 0x5B, 0x78, 0x5D, 0x22, // $8
+		},
+	},
+
+	// Data directives and their alias work in any case, after tabs and
+	// between other instructions.
+	{
+		srcName: "selftest_directives.rasm",
+		offset:  0x6800,
+		src: []string{
+			"table_start",
+			"    $\t1234",
+			"    NO; $8\t01,02; $16 0003",
+			"    $8c \"A\"; $ table_start",
+		},
+		bin: []byte{
+			0x12, 0x34, // $
+			0x00,       // NO
+			0x01, 0x02, // $8
+			0x00, 0x03, // $16
+			0x41,       // $8C
+			0x68, 0x00, // $
+		},
+	},
+
+	// Address and pointer operands within the call stack are suspicious,
+	// special addresses are not.
+	{
+		srcName: "selftest_ceiling.rasm",
+		offset:  0x6C00,
+		src: []string{
+			"    CO   $1,FF00",
+			"    CO   $1,[GP0]",
+			"    CO   *FEB0,[GP0]",
+		},
+		bin: []byte{
+			0x10, 0x00, 0x01, 0xFF, 0x00, // CO
+			0x10, 0x00, 0x01, 0xFF, 0xF0, // CO
+			0x14, 0xFE, 0xB0, 0xFF, 0xF0, // CO
+		},
+		warnings: []string{
+			"Address FF00 is outside the address space, which ends below FEB0",
+			"Address FEB0 is outside the address space, which ends below FEB0",
+		},
+	},
+
+	// Labels followed by comments, with or without whitespace in between,
+	// are still labels.
+	{
+		srcName: "selftest_labelcomment.rasm",
+		offset:  0x6400,
+		src: []string{
+			"start_here # Entry point",
+			"    NO",
+			"no_space#Comment",
+			"    NO",
+			"\ttabbed\t# Comment",
+			"    NO",
+			"    JM   $start_here",
+			"    JM   $no_space",
+			"    JM   $tabbed",
+		},
+		bin: []byte{
+			0x00,             // NO
+			0x00,             // NO
+			0x00,             // NO
+			0xE8, 0x64, 0x00, // JM
+			0xE8, 0x64, 0x01, // JM
+			0xE8, 0x64, 0x02, // JM
+		},
+	},
+
+	// The program size symbol resolves to all code and data in bytes.
+	{
+		srcName: "selftest_size.rasm",
+		offset:  0x6000,
+		src: []string{
+			"    CO   $1,[GP0]",
+			"    $16  __SIZE__,1234",
+			"    $8   01",
+		},
+		bin: []byte{
+			0x10, 0x00, 0x01, 0xFF, 0xF0, // CO16
+			0x00, 0x0A, 0x12, 0x34, // $16
+			0x01, // $8
+		},
+	},
+
+	// Expressions on interrupt vector constants land on vector boundaries,
+	// with a warning for misaligned results.
+	{
+		srcName: "selftest_irq.rasm",
+		offset:  0x5C00,
+		src: []string{
+			"[VECTOR] [IRQ0]+2*3",
+			"    $16  [IRQ3]+0,[IRQ0]+2*3,[VECTOR]",
+			"    JM   [IRQ5]",
+			"    CO   $1,[IRQ0] + 1",
+		},
+		bin: []byte{
+			0xFF, 0xC6, 0xFF, 0xC6, 0xFF, 0xC6, // $16
+			0xE8, 0xFF, 0xCA, // JM
+			0x10, 0x00, 0x01, 0xFF, 0xC1, // CO16
+		},
+		warnings: []string{
+			"Interrupt vector expression [IRQ0] + 1 results in misaligned address FFC1",
+		},
+	},
+
+	// Signed decimal data values, given a comment character other than the
+	// decimal token.
+	{
+		srcName:     "selftest_decimal.rasm",
+		offset:      0x5800,
+		commentChar: "%",
+		src: []string{
+			"    $16  #-1,#1000, #0",
+			"    $8   #-128,#255,#10 % Comment",
+			"    $8   #-1 %Comment",
+		},
+		bin: []byte{
+			0xFF, 0xFF, 0x03, 0xE8, 0x00, 0x00, // $16
+			0x80, 0xFF, 0x0A, // $8
+			0xFF, // $8
+		},
+	},
+
+	// With the default comment character, the decimal token always starts a
+	// comment, even when directly followed by a digit.
+	{
+		srcName: "selftest_hashcomment.rasm",
+		offset:  0x5A00,
+		src: []string{
+			"    $8   01,02 #2 entries follow",
+			"    $16  1234 #1st entry",
+		},
+		bin: []byte{
+			0x01, 0x02, // $8
+			0x12, 0x34, // $16
+		},
+	},
+
+	// Programs ending right at the address space ceiling.
+	{
+		srcName: "selftest_ceilingend.rasm",
+		offset:  0xFEAB,
+		src: []string{
+			"    CO   $1,[GP0]",
+		},
+		bin: []byte{
+			0x10, 0x00, 0x01, 0xFF, 0xF0, // CO16
+		},
+	},
+	{
+		srcName: "selftest_ceilingbyte.rasm",
+		offset:  0xFEAF,
+		src: []string{
+			"    $8   FF",
+		},
+		bin: []byte{
+			0xFF, // $8
+		},
+	},
+
+	// Labels of align directives resolve to the padded address.
+	{
+		srcName: "selftest_align.rasm",
+		offset:  0x5000,
+		src: []string{
+			"    NO",
+			"table_data",
+			"    .align 10",
+			"    $8   AA",
+			"    ALIGN 2",
+			"    JM   $table_data",
+		},
+		bin: []byte{
+			0x00, // NO
+			// .align 10
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0xAA,             // $8
+			0x00,             // ALIGN 2
+			0xE8, 0x50, 0x10, // JM
+		},
+	},
+
+	// Each bank starts over at the program offset and is aligned on its own,
+	// its image preceded by a bank header with its number and length.
+	{
+		srcName: "selftest_bank.rasm",
+		offset:  0x3400,
+		src: []string{
+			"    NO",
+			"    ALIGN 4",
+			"    $8   01",
+			"    BANK 1",
+			"    $8   02",
+			"    ALIGN 10",
+			"again",
+			"    JM   $again",
+		},
+		bin: []byte{
+			0x12, 0x31, 0x1C, 0xBA, 0x00, 0x00, 0x05, // Bank 0 header
+			0x00,             // NO
+			0x00, 0x00, 0x00, // ALIGN 4
+			0x01,                                     // $8
+			0x12, 0x31, 0x1C, 0xBA, 0x01, 0x00, 0x13, // Bank 1 header
+			0x02, // $8
+			// ALIGN 10
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0xE8, 0x34, 0x10, // JM
+		},
+	},
+
+	// Align boundaries may be decimal, and labels ending with the label end
+	// token may share the line of an align directive.
+	{
+		srcName: "selftest_alignlabel.rasm",
+		offset:  0x4600,
+		src: []string{
+			"    .align 256",
+			"    NO",
+			"table: .align 16",
+			"    $8   AA",
+			"after: .align 20",
+			"    JM   $table",
+			"    JM   $after",
+		},
+		bin: []byte{
+			0x00, // NO
+			// table: .align 16
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0xAA, // $8
+			// after: .align 20
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0xE8, 0x46, 0x10, // JM
+			0xE8, 0x46, 0x20, // JM
+		},
+	},
+
+	// Labels sharing a prefix are expanded by their exact name.
+	{
+		srcName: "selftest_prefix.rasm",
+		offset:  0x4400,
+		src: []string{
+			"start",
+			"    NO",
+			"startup",
+			"    CO16 $startup,*start",
+			"    JM   $start",
+		},
+		bin: []byte{
+			0x00,                         // NO
+			0x11, 0x44, 0x01, 0x44, 0x00, // CO16
+			0xE8, 0x44, 0x00, // JM
+		},
+	},
+
+	// Lines ending with a continue token outside quotes continue on the next.
+	{
+		srcName: "selftest_continue.rasm",
+		offset:  0x3800,
+		src: []string{
+			`    $8   01,02, \`,
+			"         03",
+			`    $8   "a\\", \`,
+			`         "b"`,
+			`    CO16 $0001, \`,
+			"         [GP0]",
+		},
+		bin: []byte{
+			0x01, 0x02, 0x03, // $8
+			0x22, 0x61, 0x5C, 0x22, 0x22, 0x62, 0x22, // $8
+			0x10, 0x00, 0x01, 0xFF, 0xF0, // CO16
+		},
+	},
+
+	// 8-bit data values of one or two hexadecimal digits.
+	{
+		srcName: "selftest_data8.rasm",
+		offset:  0x3C00,
+		src: []string{
+			"    $8   FF,1",
+			"    $8   01",
+		},
+		bin: []byte{
+			0xFF, 0x01, // $8
+			0x01, // $8
+		},
+	},
+
+	// Value directives name values used in operands and data.
+	{
+		srcName: "selftest_equ.rasm",
+		offset:  0x4000,
+		src: []string{
+			"speed EQU 10",
+			"    CO16 $speed,[GP0]",
+			"    $16  speed",
+			"#redefine speed equ 20",
+		},
+		bin: []byte{
+			0x10, 0x00, 0x20, 0xFF, 0xF0, // CO16
+			0x00, 0x20, // $16
+		},
+	},
+
+	// Notes emit no code and take no address space.
+	{
+		srcName: "selftest_note.rasm",
+		offset:  0x4800,
+		src: []string{
+			`    .note "Setup"`,
+			"    NO",
+			"main_loop",
+			`    NOTE "Main, loop"`,
+			"    JM   $main_loop",
+		},
+		bin: []byte{
+			0x00,             // NO
+			0xE8, 0x48, 0x01, // JM
+		},
+	},
+
+	// Null repeats match the width of their data directive.
+	{
+		srcName: "selftest_nullrepeat.rasm",
+		offset:  0x4C00,
+		src: []string{
+			"    $8   (3)",
+			"    $16  (3)",
+			"    $8   FF",
+		},
+		bin: []byte{
+			0x00, 0x00, 0x00, // $8
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // $16
+			0xFF, // $8
+		},
+	},
+
+	// Strings mixed with other values in data directives.
+	{
+		srcName: "selftest_mixed.rasm",
+		offset:  0x5400,
+		src: []string{
+			`    $8   "Hi",00,FF`,
+			`    $8   01, "a,b","",02`,
+		},
+		bin: []byte{
+			0x22, 0x48, 0x69, 0x22, 0x00, 0xFF, // $8
+			0x01, 0x22, 0x61, 0x2C, 0x62, 0x22, 0x22, 0x22, 0x02, // $8
+		},
+	},
+
+	// Redefined preprocessor constants take their last value, and redefining
+	// an undefined constant defines it.
+	{
+		srcName: "selftest_redefine.rasm",
+		offset:  0x5800,
+		src: []string{
+			"[PORT]  10",
+			"#redefine [PORT] 20",
+			"    $16  [PORT],[FRESH]",
+			"#redefine [FRESH] 30",
+		},
+		bin: []byte{
+			0x00, 0x20, 0x00, 0x30, // $16
+		},
+	},
+
+	// External labels resolve to the label exported under the same name.
+	{
+		srcName: "selftest_extern.rasm",
+		offset:  0x5A80,
+		src: []string{
+			"EXTERN lib_entry",
+			"    JS   $lib_entry",
+			"<testdata/extern_lib",
+		},
+		bin: []byte{
+			0xF0, 0x5A, 0x83, // JS
+			0xF8, 0x00, 0x00, // RT
+		},
+	},
+
+	// Hex escape sequences in strings stand for any byte value.
+	{
+		srcName: "selftest_hexescape.rasm",
+		offset:  0x5800,
+		src: []string{
+			`    $8   "A\x00\xfF\x7e"`,
+		},
+		bin: []byte{
+			0x22, 0x41, 0x00, 0xFF, 0x7E, 0x22, // $8
+		},
+	},
+}
+
+// Test definition for source code that must fail to assemble.
+type testFailure struct {
+	srcName     string
+	commentChar string // Comment character, the default if empty.
+	src         []string
+	err         string // Expected error message, one line per error.
+}
+
+// Test failures.
+var testFailures = []testFailure{
+	// Tokens starting with the data line token are data directives only if
+	// they are known directives.
+	{
+		srcName: "selftest_ambiguous.rasm",
+		src: []string{
+			"    $foo 1,2",
+		},
+		err: "Ambiguous token $foo, data directives are $, $16, $8, $8C",
+	},
+
+	// Duplicate labels name the lines of both definitions.
+	{
+		srcName: "selftest_dupe.rasm",
+		src: []string{
+			"again",
+			"    NO",
+			"again",
+			"    NO",
+		},
+		err: "Duplicate label selftest_dupe.again on line 3 (first defined on line 1)",
+	},
+
+	// Literals too wide for 8-bit instructions are not truncated.
+	{
+		srcName: "selftest_width.rasm",
+		src: []string{
+			"    AD8  $1234,[GP0L]",
+		},
+		err: "Literal $1234 does not fit in 8 bits for AD8, use AD16 instead",
+	},
+
+	// An escaped include token starts an ordinary line of source code.
+	{
+		srcName: "selftest_escinc.rasm",
+		src: []string{
+			`    \<XY $1`,
+		},
+		err: "Invalid mnemonic <XY",
+	},
+
+	// Preprocessor constants do not leak from one assembly into the next.
+	{
+		srcName: "selftest_leak.rasm",
+		src: []string{
+			"    CO   $1,[PORTA]",
+		},
+		err: "Preprocessor constant [PORTA] not defined",
+	},
+
+	// Preprocessor constant arithmetic stays within 16 bits.
+	{
+		srcName: "selftest_constover.rasm",
+		src: []string{
+			"[BIG]   FFFF+1",
+		},
+		err: "Value exceeds FFFF in preprocessor constant [BIG]",
+	},
+
+	// Preprocessor constant arithmetic does not divide by zero.
+	{
+		srcName: "selftest_constdiv.rasm",
+		src: []string{
+			"[ZERO]  0",
+			"[DIV]   10/[ZERO]",
+		},
+		err: "Division by zero in preprocessor constant [DIV]",
+	},
+
+	// All undefined preprocessor constants are reported, once per line.
+	{
+		srcName: "selftest_undefined.rasm",
+		src: []string{
+			"    CO   [NOPE],[NADA]",
+			"    CO   [NOPE],[NOPE]",
+		},
+		err: "Preprocessor constant [NOPE] not defined\nPreprocessor constant [NADA] not defined\nPreprocessor constant [NOPE] not defined",
+	},
+
+	// Operand prefixes need a value, and only one prefix is allowed.
+	{
+		srcName: "selftest_literal.rasm",
+		src:     []string{"    CO   $,[GP0]"},
+		err:     "Operand prefix $ without a value",
+	},
+	{
+		srcName: "selftest_pointer.rasm",
+		src:     []string{"    CO   $1,*"},
+		err:     "Operand prefix * without a value",
+	},
+	{
+		srcName: "selftest_literals.rasm",
+		src:     []string{"    CO   $$1,[GP0]"},
+		err:     "Stacked operand prefixes in $$1",
+	},
+	{
+		srcName: "selftest_pointers.rasm",
+		src:     []string{"    CO   **1,[GP0]"},
+		err:     "Stacked operand prefixes in **1",
+	},
+	{
+		srcName: "selftest_size8.rasm",
+		src:     []string{"    $8   __SIZE__"},
+		err:     "__SIZE__ needs 16-bit data",
+	},
+	{
+		srcName:     "selftest_decimal8.rasm",
+		commentChar: "%",
+		src:         []string{"    $8   #1,#256"},
+		err:         "Decimal value #256 does not fit in $8",
+	},
+	{
+		srcName:     "selftest_decimal16.rasm",
+		commentChar: "%",
+		src:         []string{"    $16  #-32769"},
+		err:         "Decimal value #-32769 does not fit in $16",
+	},
+	{
+		srcName: "selftest_overflow.rasm",
+		src: []string{
+			"    ORG  FEAC",
+			"    CO   $1,[GP0]",
+			"    NO",
+		},
+		err: "Program of 6 bytes at offset FEAC exceeds the address space, which ends below FEB0",
+	},
+	{
+		srcName: "selftest_unknownpragma.rasm",
+		src:     []string{"#pragma speed 10", "    NO"},
+		err:     "Unknown pragma speed",
+	},
+	{
+		srcName: "selftest_latepragma.rasm",
+		src:     []string{"    NO", "#pragma offset 1000"},
+		err:     "#pragma offset is only allowed at the start of the program",
+	},
+	{
+		srcName: "selftest_orgoffset.rasm",
+		src:     []string{"#pragma offset 1000", "    ORG  2000", "    NO"},
+		err:     "ORG 2000 disagrees with program offset 1000",
+	},
+	{
+		srcName: "selftest_bankoverflow.rasm",
+		src: []string{
+			"    ORG  FEA0",
+			"    NO",
+			"    BANK 1",
+			"    NO",
+			"    ALIGN 10",
+			"    NO",
+			"    BANK 2",
+			"    NO",
+		},
+		err: "Program of 17 bytes at offset FEA0 exceeds the address space, which ends below FEB0",
+	},
+	{
+		srcName: "selftest_align3.rasm",
+		src:     []string{"    ALIGN 3"},
+		err:     "Invalid ALIGN boundary 3, use a power of two",
+	},
+	{
+		srcName: "selftest_shortpointer.rasm",
+		src:     []string{"    CO8  *12,[GP0]"},
+		err:     "Pointer *12 looks like an 8-bit literal, write $12 for a literal or *0012 for a pointer",
+	},
+	{
+		srcName: "selftest_lastpointer.rasm",
+		src:     []string{"    CO   $1,*FFFF"},
+		err:     "Pointer *FFFF leaves no room for a 16-bit address",
+	},
+	{
+		srcName: "selftest_mixedstring.rasm",
+		src:     []string{`    $8   00,"abc`},
+		err:     `Unterminated string "abc`,
+	},
+	{
+		srcName: "selftest_notestring.rasm",
+		src:     []string{"    .note 12"},
+		err:     "NOTE needs a string",
+	},
+	{
+		srcName: "selftest_unquotedinc.rasm",
+		src:     []string{"#include selftest_lib"},
+		err:     "Include file name selftest_lib must be quoted",
+	},
+	{
+		srcName: "selftest_continueend.rasm",
+		src:     []string{"    NO", `    $8   01, \`},
+		err:     `Line continuation \ without a following line`,
+	},
+	{
+		srcName: "selftest_data8wide.rasm",
+		src:     []string{"    $8   FF,100"},
+		err:     "Invalid 8-bit data in directive",
+	},
+	{
+		srcName: "selftest_equagain.rasm",
+		src:     []string{"speed EQU 10", "speed EQU 20"},
+		err:     "Cannot redefine EQU value selftest_equagain.speed without #redefine",
+	},
+	{
+		srcName: "selftest_runaway.rasm",
+		src:     []string{"    $8   (1000000)"},
+		err:     "Data null repeat (1000000) exceeds the expanded source limit of 250000 lines",
+	},
+	{
+		srcName: "selftest_constagain.rasm",
+		src:     []string{"[PORT]  10", "[PORT]  20"},
+		err:     "Cannot redefine preprocessor constant [PORT] without #redefine",
+	},
+	{
+		srcName: "selftest_noglobal.rasm",
+		src:     []string{"EXTERN lib_entry", "    JS   $lib_entry"},
+		err:     "External label lib_entry not exported by any GLOBAL",
+	},
+	{
+		srcName: "selftest_dupglobal.rasm",
+		src:     []string{"GLOBAL lib_entry", "lib_entry", "    NO", "<testdata/extern_lib"},
+		err:     "Label lib_entry already exported as selftest_dupglobal.lib_entry",
+	},
+	{
+		srcName: "selftest_shortescape.rasm",
+		src:     []string{`    $8   "A\x4"`},
+		err:     `Invalid hex escape sequence \x4`,
+	},
+	{
+		srcName: "selftest_nonhexescape.rasm",
+		src:     []string{`    $8   "A\xG1B"`},
+		err:     `Invalid hex escape sequence \xG1`,
+	},
+	{
+		srcName: "testdata/cycle_a.rasm",
+		src:     []string{"<cycle_b"},
+		err:     "Circular include: testdata/cycle_a.rasm -> testdata/cycle_b._rasm -> testdata/cycle_c._rasm -> testdata/cycle_b._rasm",
+	},
+}
+
+// -----------------------------------------------------------------------------
+
+// TestMain runs the package tests without debug output, which would otherwise
+// drown out the test results and slow down fuzzing.
+func TestMain(m *testing.M) {
+	DEBUG = false
+
+	os.Exit(m.Run())
+}
+
+// -----------------------------------------------------------------------------
+
+// getAllTestPrograms returns the self-test program followed by the test
+// programs.
+func getAllTestPrograms() []testProgram {
+	return append([]testProgram{selfTestProgram}, testPrograms...)
+}
+
+// -----------------------------------------------------------------------------
+
+// getTestOptions returns the default options with the given comment character,
+// if any.
+func getTestOptions(commentChar string) Options {
+	opts := DefaultOptions()
+	if commentChar != "" {
+		opts.CommentChar = commentChar
+	}
+
+	return opts
+}
+
+// -----------------------------------------------------------------------------
+
+// assembleTest assembles a single source file using the given options.
+func assembleTest(src []string, srcName string, programOffset uint16, opts Options) ([]byte, *assembly, error) {
+	asm := newAssembly(opts)
+
+	bin, err := asm.assembleFiles([][]string{src}, []string{srcName}, programOffset)
+
+	return bin, asm, err
+}
+
+// -----------------------------------------------------------------------------
+
+// TestSelfTest runs the self-test built into the binary.
+func TestSelfTest(t *testing.T) {
+	err := SelfTest()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// TestPrograms assembles every test program and compares the result with the
+// expected header, binary and warnings.
+func TestPrograms(t *testing.T) {
+	for _, program := range getAllTestPrograms() {
+		bin, asm, err := assembleTest(program.src, program.srcName, program.offset, getTestOptions(program.commentChar))
+		if err == nil {
+			err = checkTestProgram(program, bin, asm.warnings)
+		}
+
+		if err != nil {
+			t.Error(program.srcName + ": " + err.Error())
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// TestRoundTrip verifies that every test program survives a round trip through
+// the disassembler.
+func TestRoundTrip(t *testing.T) {
+	for _, program := range getAllTestPrograms() {
+		err := roundTrip(program.src, program.srcName, program.offset, getTestOptions(program.commentChar))
+		if err != nil {
+			t.Error(program.srcName + ": " + err.Error())
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// TestFailures assembles source code that must fail and compares the resulting
+// error messages with the expected ones.
+func TestFailures(t *testing.T) {
+	for _, failure := range testFailures {
+		_, _, err := assembleTest(failure.src, failure.srcName, 0, getTestOptions(failure.commentChar))
+		if err == nil {
+			t.Error(failure.srcName + ": assembled source code that must fail")
+
+			continue
+		}
+
+		var messages []string
+
+		switch assembleErr := err.(type) {
+		case AssembleError:
+			messages = append(messages, assembleErr.Message)
+		case AssembleErrors:
+			for _, oneErr := range assembleErr {
+				messages = append(messages, oneErr.Message)
+			}
+		}
+
+		if strings.Join(messages, "\n") != failure.err {
+			t.Error(failure.srcName + ": expected \"" + failure.err + "\", got \"" + err.Error() + "\"")
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// TestEntryPoint assembles a program with an entry point label and verifies
+// that the header records its address, and that an undefined entry point label
+// fails.
+func TestEntryPoint(t *testing.T) {
+	src := []string{
+		"    $16  1234",
+		"start",
+		"    NO",
+	}
+
+	opts := DefaultOptions()
+	opts.HeaderVersion = headerVersionEntry
+	opts.EntryLabel = "start"
+
+	bin, _, err := assembleTest(src, "selftest_entry.rasm", 0x2000, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, err := ReadHeader(bin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if header.ProgramOffset != 0x2000 || header.EntryPoint != 0x2002 || formatBytes(bin[header.Length:]) != "12 34 00" {
+		t.Error("Entry point mismatch, got " + formatBytes(bin))
+	}
+
+	opts.EntryLabel = "nowhere"
+
+	_, _, err = assembleTest(src, "selftest_entry.rasm", 0x2000, opts)
+	if err == nil {
+		t.Error("Accepted undefined entry point label")
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// TestValidateSource validates source code with a warning and an error and
+// verifies that both are returned with their line numbers.
+func TestValidateSource(t *testing.T) {
+	src := []string{
+		"    DV   $0,[GP0]",
+		"    CO   $1",
+	}
+
+	diagnostics := ValidateSource(src, "selftest_validate.rasm")
+
+	if len(diagnostics) != 2 || !diagnostics[0].Warning || diagnostics[0].LineNum != 1 || diagnostics[1].Warning || diagnostics[1].LineNum != 2 {
+		var descrs []string
+		for _, diagnostic := range diagnostics {
+			descrs = append(descrs, diagnostic.Error())
+		}
+
+		t.Error("Validation mismatch, got \"" + strings.Join(descrs, "; ") + "\"")
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// TestWarningsAsErrors assembles a program causing a warning with warnings
+// treated as errors and verifies that no binary is built.
+func TestWarningsAsErrors(t *testing.T) {
+	opts := DefaultOptions()
+	opts.WarningsAsErrors = true
+
+	bin, asm, err := assembleTest([]string{"    DV   $0,[GP0]"}, "selftest_strict.rasm", 0, opts)
+
+	assembleErr, ok := err.(AssembleError)
+	if bin != nil || !ok || assembleErr.Warning || assembleErr.LineNum != 1 || len(asm.warnings) > 0 {
+		t.Errorf("Strict mode mismatch, got \"%v\"", err)
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// TestOffsetPragma assembles a program setting its own program offset and
+// verifies that the offset applies to both header and addresses.
+func TestOffsetPragma(t *testing.T) {
+	program := testProgram{
+		srcName: "selftest_pragma.rasm",
+		offset:  0x5E00,
+		src: []string{
+			"#pragma offset 5E00",
+			"again",
+			"    JM   $again",
+		},
+		bin: []byte{
+			0xE8, 0x5E, 0x00, // JM
+		},
+	}
+
+	bin, asm, err := assembleTest(program.src, program.srcName, 0, DefaultOptions())
+	if err == nil {
+		err = checkTestProgram(program, bin, asm.warnings)
+	}
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// TestExplicitOffset assembles a program whose origin directive disagrees with
+// an explicitly given program offset and verifies that it fails, while the
+// same program offset given implicitly gives way to the origin directive.
+func TestExplicitOffset(t *testing.T) {
+	src := []string{"    ORG  2000", "    NO"}
+
+	opts := DefaultOptions()
+	opts.ExplicitOffset = true
+
+	_, _, err := assembleTest(src, "selftest_explicit.rasm", 0x1000, opts)
+
+	assembleErr, ok := err.(AssembleError)
+	if !ok || assembleErr.Message != "ORG 2000 disagrees with program offset 1000" {
+		t.Errorf("Explicit offset mismatch, got \"%v\"", err)
+	}
+
+	opts.ExplicitOffset = false
+
+	bin, _, err := assembleTest(src, "selftest_explicit.rasm", 0x1000, opts)
+
+	header, headerErr := ReadHeader(bin)
+	if err != nil || headerErr != nil || header.ProgramOffset != 0x2000 {
+		t.Errorf("Implicit offset mismatch, got \"%v\"", err)
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// TestJumpTargets assembles a program jumping into data with jump targets
+// checked and warnings treated as errors, and verifies that it fails.
+func TestJumpTargets(t *testing.T) {
+	src := []string{
+		"    JM   $table_data",
+		"table_data",
+		"    $8   01,02",
+	}
+
+	opts := DefaultOptions()
+	opts.CheckJumpTargets = true
+	opts.WarningsAsErrors = true
+
+	_, _, err := assembleTest(src, "selftest_jumpdata.rasm", 0x1000, opts)
+
+	assembleErr, ok := err.(AssembleError)
+	if !ok || assembleErr.Message != "Jump target selftest_jumpdata.table_data (1003) is data" {
+		t.Errorf("Jump target mismatch, got \"%v\"", err)
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// TestInstrDlm assembles several instructions sharing a line using a custom
+// instruction delimiter, which lets the default one serve as the comment
+// character, and verifies that clashing delimiters are rejected.
+func TestInstrDlm(t *testing.T) {
+	opts := getTestOptions(";")
+	opts.InstrDlm = "|"
+
+	bin, _, err := assembleTest([]string{"    NO | $8 01 ; NO | NO"}, "selftest_instrdlm.rasm", 0, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []byte{0x00, 0x01}
+	if !bytes.Equal(bin[len(bin)-len(expected):], expected) {
+		t.Errorf("Instruction delimiter mismatch, expected %v, got %v", formatBytes(expected), formatBytes(bin))
+	}
+
+	for _, clash := range []struct{ commentChar, instrDlm, dataDlm string }{
+		{";", ";", ","},
+		{"#", "", ","},
+		{"#", ",", ","},
+		{"#", "$", ","},
+		{"#", "|", "|"},
+	} {
+		opts := getTestOptions(clash.commentChar)
+		opts.InstrDlm, opts.DataDlm = clash.instrDlm, clash.dataDlm
+
+		if err := validateOptions(opts); err == nil {
+			t.Errorf("Accepted instruction delimiter %q with comment character %q and data delimiter %q", clash.instrDlm, clash.commentChar, clash.dataDlm)
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// TestExample assembles the example program shipped with the assembler, along
+// with the standard library files it includes.
+func TestExample(t *testing.T) {
+	srcName := filepath.Join("..", "example"+file.SrcExt)
+
+	src, err := file.ReadSrc(srcName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, asm, err := assembleTest(src, srcName, 0, DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, warning := range asm.warnings {
+		t.Error(warning)
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// TestStructSrc formats the structured source code of a small program and
+// verifies the result.
+func TestStructSrc(t *testing.T) {
+	src := []string{
+		"start_here",
+		"    CO   $1,*[GP0]",
+		"    $8   01,02",
+		"    JM   $start_here",
+	}
+
+	expected := []string{
+		"2\t0300\tselftest_struct.start_here\tCO16\t$1,*FFF0",
+		"3\t0305\t\t$8\t01,02",
+		"4\t0307\t\tJM\t$selftest_struct.start_here",
+	}
+
+	srcLines, _, err := newAssembly(DefaultOptions()).buildAddressedSrc([][]string{src}, []string{"selftest_struct.rasm"}, 0x0300)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	structSrc := formatStructSrc(srcLines)
+
+	if strings.Join(structSrc, "\n") != strings.Join(expected, "\n") {
+		t.Error("Structured source mismatch, got \"" + strings.Join(structSrc, "; ") + "\"")
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// TestEmptyInc processes an include file containing only comments and verifies
+// that it contributes no source code.
+func TestEmptyInc(t *testing.T) {
+	opts := DefaultOptions()
+
+	emptyInc := []string{
+		opts.CommentChar + " Comments only",
+		"",
+		"    " + opts.CommentChar + " Indented comment",
+		"\t",
+	}
+
+	incLines, _, err := newAssembly(opts).processIncSrc(emptyInc, "selftest_empty"+file.IncExt, []string{"selftest"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, incLine := range incLines {
+		if incLine != "" {
+			t.Error("Empty include produced source code: " + incLine)
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// FuzzRaw feeds arbitrary source code through the complete assembly process,
+// seeded with the test programs and failures. Errors are expected results,
+// while panics fail.
+func FuzzRaw(f *testing.F) {
+	for _, program := range getAllTestPrograms() {
+		f.Add(strings.Join(program.src, "\n"))
+	}
+
+	for _, failure := range testFailures {
+		f.Add(strings.Join(failure.src, "\n"))
+	}
+
+	f.Fuzz(func(t *testing.T, src string) {
+		assembleTest(strings.Split(src, "\n"), "fuzz.rasm", 0, DefaultOptions())
+	})
+}
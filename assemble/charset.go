@@ -0,0 +1,137 @@
+/*
+Copyright 2018-2019 Juan Irming
+
+This file is part of rasm16.
+
+rasm16 is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+rasm16 is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with rasm16.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package assemble
+
+import (
+	"errors"
+	"rasm/file"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// -----------------------------------------------------------------------------
+
+// Charset table definition, mapping characters to the byte values emitted for
+// them by charset data directives.
+type Charset map[rune]byte
+
+// Built-in charset table definitions.
+var builtinCharsets = map[string]Charset{
+	"ascii":      asciiCharset(),
+	"screencode": screenCodeCharset(),
+}
+
+// Default charset name.
+const defaultCharsetName string = "ascii"
+
+// Charset table used by charset data directives.
+var activeCharset Charset = builtinCharsets[defaultCharsetName]
+
+// -----------------------------------------------------------------------------
+
+// LoadCharset selects the charset table used by charset data directives, see
+// ReadCharset.
+func LoadCharset(name string) error {
+	loadedCharset, err := ReadCharset(name)
+	if err != nil {
+		return err
+	}
+
+	activeCharset = loadedCharset
+
+	return nil
+}
+
+// -----------------------------------------------------------------------------
+
+// ReadCharset returns a charset table, either by built-in name or by reading a
+// charset file from disk. Each non-empty line of a charset file holds a
+// hexadecimal byte value, a single space and the character it represents, e.g.
+// "01 A". Lines starting with the comment character are ignored.
+func ReadCharset(name string) (Charset, error) {
+	if builtin, exists := builtinCharsets[name]; exists {
+		return builtin, nil
+	}
+
+	lines, err := file.ReadSrc(name)
+	if err != nil {
+		return nil, err
+	}
+
+	loadedCharset := Charset{}
+
+	for lineNum, line := range lines {
+		if line == "" || strings.HasPrefix(line, CommentChar) {
+			continue
+		}
+
+		splitLine := strings.SplitN(line, " ", 2)
+
+		if len(splitLine) < 2 || !is8BitHexString(splitLine[0]) || utf8.RuneCountInString(splitLine[1]) != 1 {
+			return nil, errors.New(name + ":" + strconv.Itoa(lineNum+1) + ":\tInvalid charset entry " + line)
+		}
+
+		value, _ := strconv.ParseUint(splitLine[0], 16, 8)
+		char, _ := utf8.DecodeRuneInString(splitLine[1])
+
+		loadedCharset[char] = byte(value)
+	}
+
+	return loadedCharset, nil
+}
+
+// -----------------------------------------------------------------------------
+
+// asciiCharset builds the 7-bit ASCII charset table.
+func asciiCharset() Charset {
+	table := Charset{}
+
+	for char := rune(0); char < 0x80; char++ {
+		table[char] = byte(char)
+	}
+
+	return table
+}
+
+// -----------------------------------------------------------------------------
+
+// screenCodeCharset builds the upper case screen code charset table used by
+// PETSCII-style character displays.
+func screenCodeCharset() Charset {
+	table := Charset{
+		'@': 0x00,
+		'[': 0x1B,
+		'£': 0x1C,
+		']': 0x1D,
+		'↑': 0x1E,
+		'←': 0x1F,
+	}
+
+	for char := 'A'; char <= 'Z'; char++ {
+		table[char] = byte(char - 'A' + 0x01)
+	}
+
+	for char := ' '; char <= '?'; char++ {
+		table[char] = byte(char)
+	}
+
+	return table
+}
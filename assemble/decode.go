@@ -0,0 +1,157 @@
+/*
+Copyright 2018-2019 Juan Irming
+
+This file is part of rasm16.
+
+rasm16 is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+rasm16 is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with rasm16.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package assemble
+
+import (
+	"errors"
+	"strconv"
+)
+
+// -----------------------------------------------------------------------------
+
+// OpType is the type of an operand of a decoded instruction.
+type OpType int
+
+// Decoded operand type definitions, matching the parser's operand types.
+const (
+	NoOperand       OpType = OpType(invalidOp)
+	AddressOperand  OpType = OpType(addressOp)
+	LiteralOperand  OpType = OpType(literalOp)
+	PointerOperand  OpType = OpType(pointerOp)
+	RelativeOperand OpType = OpType(relativeOp)
+)
+
+// DecodedOpcode describes an instruction as identified by its opcode.
+type DecodedOpcode struct {
+	Mnemonic string
+	Op1Type  OpType
+	Op2Type  OpType
+	Length   int // Instruction length in bytes, including operands.
+}
+
+// Operand types of two-operand instructions per addressing mode, i.e. the
+// lowest three bits of an opcode byte.
+var addressingModeOpTypes = [][2]opType{
+	{literalOp, addressOp},
+	{literalOp, pointerOp},
+	{addressOp, addressOp},
+	{addressOp, pointerOp},
+	{pointerOp, addressOp},
+	{pointerOp, pointerOp},
+}
+
+// Addressing mode of relative single operands.
+const relativeAddressingMode byte = 0x06
+
+// -----------------------------------------------------------------------------
+
+// String returns the human-readable description of an operand type.
+func (t OpType) String() string {
+	if t == NoOperand {
+		return "NONE"
+	}
+
+	if descr, exists := opDescr[opType(t)]; exists {
+		return descr
+	}
+
+	return defaultOpDescr
+}
+
+// -----------------------------------------------------------------------------
+
+// DecodeOpcode identifies the instruction starting at the beginning of a byte
+// slice by undoing the opcode encoding, i.e. returns its mnemonic, operand
+// types and length. Single operands are encoded alike whether literal or
+// address, so they decode as literals if the mnemonic allows them.
+func DecodeOpcode(bin []byte) (DecodedOpcode, error) {
+	if len(bin) == 0 {
+		return DecodedOpcode{}, errors.New("Missing opcode")
+	}
+
+	opcode := bin[0] >> 3
+	mode := bin[0] & 0x07
+
+	name, exists := getOpcodeMnemonics()[opcode]
+	if !exists {
+		return DecodedOpcode{}, errors.New("Unknown opcode " + formatBytes(bin[:1]))
+	}
+
+	op1Type, op2Type, valid := decodeOpTypes(name, mode)
+	if !valid {
+		return DecodedOpcode{}, errors.New("Invalid addressing mode " + strconv.Itoa(int(mode)) + " for " + name + " in opcode " + formatBytes(bin[:1]))
+	}
+
+	return DecodedOpcode{
+		Mnemonic: name,
+		Op1Type:  OpType(op1Type),
+		Op2Type:  OpType(op2Type),
+		Length:   mnemonics[name].instrLength,
+	}, nil
+}
+
+// -----------------------------------------------------------------------------
+
+// getOpcodeMnemonics maps the opcode of every instruction to its mnemonic.
+func getOpcodeMnemonics() map[byte]string {
+	opcodeMnemonics := make(map[byte]string)
+
+	for name, mnemonic := range mnemonics {
+		if mnemonic.instrLength != 0 {
+			opcodeMnemonics[mnemonic.opcode] = name
+		}
+	}
+
+	return opcodeMnemonics
+}
+
+// -----------------------------------------------------------------------------
+
+// decodeOpTypes determines the operand types of an instruction from its
+// addressing mode, and whether the mnemonic allows them.
+func decodeOpTypes(name string, mode byte) (opType, opType, bool) {
+	op1Type, op2Type := invalidOp, invalidOp
+
+	switch numOps := mnemonics[name].numOps; {
+	case numOps == 0 && mode == 0:
+		return op1Type, op2Type, true
+	case numOps == 1 && mode == 0:
+		op1Type = addressOp
+		if mnemonicOpTypes[name][0][literalOp] {
+			op1Type = literalOp
+		}
+	case numOps == 1 && mode == relativeAddressingMode:
+		op1Type = relativeOp
+	case numOps == 2 && int(mode) < len(addressingModeOpTypes):
+		op1Type, op2Type = addressingModeOpTypes[mode][0], addressingModeOpTypes[mode][1]
+	default:
+		return op1Type, op2Type, false
+	}
+
+	if !mnemonicOpTypes[name][0][op1Type] {
+		return op1Type, op2Type, false
+	}
+
+	if op2Type != invalidOp && !mnemonicOpTypes[name][1][op2Type] {
+		return op1Type, op2Type, false
+	}
+
+	return op1Type, op2Type, true
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2018-2019 Juan Irming
+
+This file is part of rasm16.
+
+rasm16 is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+rasm16 is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with rasm16.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package assemble
+
+import (
+	"bytes"
+	"testing"
+)
+
+// -----------------------------------------------------------------------------
+
+// TestDecodeOpcode encodes the opcode of every instruction with every allowed
+// combination of operand types and verifies that decoding it leads back to the
+// same mnemonic and encoding.
+func TestDecodeOpcode(t *testing.T) {
+	for name, mnemonic := range mnemonics {
+		if mnemonic.instrLength == 0 {
+			continue
+		}
+
+		combinations := [][2]opType{{invalidOp, invalidOp}}
+
+		for _, types := range mnemonicOpTypes[name] {
+			var nextCombinations [][2]opType
+
+			for _, combination := range combinations {
+				for allowedType := range types {
+					if combination[0] == invalidOp {
+						nextCombinations = append(nextCombinations, [2]opType{allowedType, invalidOp})
+					} else {
+						nextCombinations = append(nextCombinations, [2]opType{combination[0], allowedType})
+					}
+				}
+			}
+
+			combinations = nextCombinations
+		}
+
+		for _, combination := range combinations {
+			bin := buildOpcode(srcLine{mnemonic: name, op1Type: combination[0], op2Type: combination[1]}).bin
+
+			decoded, err := DecodeOpcode(bin)
+			if err != nil {
+				t.Error("Could not decode " + name + ": " + err.Error())
+
+				continue
+			}
+
+			redecodedBin := buildOpcode(srcLine{mnemonic: decoded.Mnemonic, op1Type: opType(decoded.Op1Type), op2Type: opType(decoded.Op2Type)}).bin
+
+			if decoded.Mnemonic != name || decoded.Length != mnemonic.instrLength || !bytes.Equal(bin, redecodedBin) {
+				t.Error("Decoded " + formatBytes(bin) + " of " + name + " as " + decoded.Mnemonic)
+			}
+		}
+	}
+
+	for _, bin := range [][]byte{{0x01}, {0x07}, {0x0F}} {
+		if _, err := DecodeOpcode(bin); err == nil {
+			t.Error("Decoded invalid opcode " + formatBytes(bin))
+		}
+	}
+}
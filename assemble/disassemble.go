@@ -0,0 +1,184 @@
+/*
+Copyright 2018-2019 Juan Irming
+
+This file is part of rasm16.
+
+rasm16 is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+rasm16 is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with rasm16.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package assemble
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// -----------------------------------------------------------------------------
+
+// Disassemble turns binary code, excluding the header, back into rasm source
+// code, one instruction per line, each followed by a comment with its address.
+// Bytes that do not form a valid instruction, e.g. data, become 8-bit data
+// directives.
+func Disassemble(code []byte, programOffset uint16) []string {
+	return newAssembly(currentOptions()).disassemble(code, programOffset)
+}
+
+// -----------------------------------------------------------------------------
+
+// disassemble does the work for Disassemble, formatting comments and data
+// directives using the options of the assembly.
+func (asm *assembly) disassemble(code []byte, programOffset uint16) []string {
+	var srcLines []string
+	var dataBytes []byte
+
+	address := int(programOffset)
+
+	flushData := func() {
+		if len(dataBytes) > 0 {
+			srcLines = append(srcLines, asm.formatDisassembledLine(directiveTokens[data8BitDirective]+" "+asm.formatDataBytes(dataBytes), address-len(dataBytes)))
+			dataBytes = nil
+		}
+	}
+
+	for offset := 0; offset < len(code); {
+		instr, ok := disassembleInstr(code[offset:])
+		if !ok {
+			dataBytes = append(dataBytes, code[offset])
+			offset++
+			address++
+
+			continue
+		}
+
+		flushData()
+
+		srcLines = append(srcLines, asm.formatDisassembledLine(instr.text, address))
+
+		offset += instr.length
+		address += instr.length
+	}
+
+	flushData()
+
+	return srcLines
+}
+
+// -----------------------------------------------------------------------------
+
+// RoundTrip assembles source code, disassembles the resulting binary and
+// assembles the disassembly again, returning an error unless both binaries are
+// identical. Entry labels and build-info footers do not survive disassembly, so
+// they make the round trip fail.
+func RoundTrip(rawSrcLines []string, srcName string, programOffset uint16) error {
+	return roundTrip(rawSrcLines, srcName, programOffset, currentOptions())
+}
+
+// -----------------------------------------------------------------------------
+
+// roundTrip does the work for RoundTrip, using the given assembly options for
+// the assemblies and the disassembly.
+func roundTrip(rawSrcLines []string, srcName string, programOffset uint16, opts Options) error {
+	asm := newAssembly(opts)
+
+	bin, err := asm.assembleFiles([][]string{rawSrcLines}, []string{srcName}, programOffset)
+	if err != nil {
+		return err
+	}
+
+	header, err := ReadHeader(bin)
+	if err != nil {
+		return err
+	}
+
+	disassembly := asm.disassemble(bin[header.Length:], header.ProgramOffset)
+
+	roundTripBin, err := newAssembly(opts).assembleFiles([][]string{disassembly}, []string{srcName}, header.ProgramOffset)
+	if err != nil {
+		return errors.New("Disassembly does not assemble: " + err.Error())
+	}
+
+	if !bytes.Equal(bin, roundTripBin) {
+		offset := 0
+		for offset < len(bin) && offset < len(roundTripBin) && bin[offset] == roundTripBin[offset] {
+			offset++
+		}
+
+		return errors.New("Round trip binary differs at offset " + strconv.Itoa(offset) + ", got " + strconv.Itoa(len(roundTripBin)) + " bytes instead of " + strconv.Itoa(len(bin)))
+	}
+
+	return nil
+}
+
+// -----------------------------------------------------------------------------
+
+// Disassembled instruction definition.
+type disassembledInstr struct {
+	text   string
+	length int
+}
+
+// disassembleInstr turns the instruction starting at the beginning of a byte
+// slice into source code, and whether there is a valid instruction at all.
+func disassembleInstr(bin []byte) (disassembledInstr, bool) {
+	decoded, err := DecodeOpcode(bin)
+	if err != nil || len(bin) < decoded.Length {
+		return disassembledInstr{}, false
+	}
+
+	opTypes := []OpType{decoded.Op1Type, decoded.Op2Type}
+	opsStart := decoded.Length - 2*mnemonics[decoded.Mnemonic].numOps
+
+	var ops []string
+
+	for i := 0; i < mnemonics[decoded.Mnemonic].numOps; i++ {
+		value := uint16(bin[opsStart+2*i])<<8 | uint16(bin[opsStart+2*i+1])
+
+		if _, is8Bit := get16BitMnemonic(decoded.Mnemonic); is8Bit && opTypes[i] == LiteralOperand && value > 0xFF {
+			return disassembledInstr{}, false
+		}
+
+		ops = append(ops, opTokens[opType(opTypes[i])]+strings.ToUpper(fmt.Sprintf("%04x", value)))
+	}
+
+	text := decoded.Mnemonic
+	if len(ops) > 0 {
+		text += mnemonicOpDlm + strings.Join(ops, opDlm)
+	}
+
+	return disassembledInstr{text: text, length: decoded.Length}, true
+}
+
+// -----------------------------------------------------------------------------
+
+// formatDisassembledLine indents a line of disassembled source code and adds a
+// comment with its address.
+func (asm *assembly) formatDisassembledLine(text string, address int) string {
+	return fmt.Sprintf("    %-24s%s %04X", text, asm.opts.CommentChar, address)
+}
+
+// -----------------------------------------------------------------------------
+
+// formatDataBytes formats bytes as values of a data directive.
+func (asm *assembly) formatDataBytes(dataBytes []byte) string {
+	var values []string
+
+	for _, dataByte := range dataBytes {
+		values = append(values, strings.ToUpper(fmt.Sprintf("%02x", dataByte)))
+	}
+
+	return strings.Join(values, asm.opts.DataDlm)
+}
@@ -0,0 +1,240 @@
+/*
+Copyright 2018-2019 Juan Irming
+
+This file is part of rasm16.
+
+rasm16 is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+rasm16 is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with rasm16.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package assemble
+
+import (
+	"strconv"
+	"strings"
+)
+
+// -----------------------------------------------------------------------------
+
+// Source line origin definition, identifying where a line of source code was
+// originally read from.
+type srcOrigin struct {
+	incName string // Empty for lines from the main source file.
+	lineNum int
+	rawLine string
+}
+
+// AssembleError describes a problem found on a specific line of source code.
+type AssembleError struct {
+	IncName string // Include file the line originates from, empty for the main source file.
+	LineNum int    // 1-based line number within the originating file.
+	Column  int    // 1-based column of the offending token, 0 if unknown.
+	Token   string
+	Message string
+	Warning bool // Whether the problem does not prevent assembly.
+}
+
+// AssembleErrors holds several problems found together, e.g. all undefined
+// preprocessor constants of a source file.
+type AssembleErrors []AssembleError
+
+// Warnings found during the most recent assembly.
+var Warnings []AssembleError
+
+// Whether warnings abort the assembly like errors do.
+var WarningsAsErrors bool = false
+
+// -----------------------------------------------------------------------------
+
+// Error formats the error in the terse form "line:<TAB>message", prefixed with
+// the include filename if the line originates from an include file. Warnings
+// are marked as such.
+func (e AssembleError) Error() string {
+	location := strconv.Itoa(e.LineNum) + ":\t"
+
+	if e.IncName != "" {
+		location = e.IncName + ":" + location
+	}
+
+	if e.Warning {
+		return location + "Warning: " + e.Message
+	}
+
+	return location + e.Message
+}
+
+// -----------------------------------------------------------------------------
+
+// Error formats each of the errors like AssembleError does, one per line.
+func (e AssembleErrors) Error() string {
+	var lines []string
+
+	for _, assembleErr := range e {
+		lines = append(lines, assembleErr.Error())
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// -----------------------------------------------------------------------------
+
+// joinAssembleErrors returns nil for no errors, a single error as is and
+// AssembleErrors for several errors.
+func joinAssembleErrors(assembleErrs []AssembleError) error {
+	switch len(assembleErrs) {
+	case 0:
+		return nil
+	case 1:
+		return assembleErrs[0]
+	}
+
+	return AssembleErrors(assembleErrs)
+}
+
+// -----------------------------------------------------------------------------
+
+// newSrcOrigins creates origins for every line of a freshly read source file.
+func newSrcOrigins(incName string, rawSrcLines []string) []srcOrigin {
+	var origins []srcOrigin
+
+	for lineNum, rawSrcLine := range rawSrcLines {
+		origins = append(origins, srcOrigin{incName: incName, lineNum: lineNum, rawLine: rawSrcLine})
+	}
+
+	return origins
+}
+
+// -----------------------------------------------------------------------------
+
+// newAssembleError creates an error for a line of source code, locating the
+// offending token in the original line if possible.
+func newAssembleError(origin srcOrigin, token string, message string) AssembleError {
+	return AssembleError{
+		IncName: origin.incName,
+		LineNum: origin.lineNum + 1,
+		Column:  findColumn(origin.rawLine, token),
+		Token:   token,
+		Message: message,
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// describeOrigin describes where a line of source code originates from for use
+// in messages, e.g. "line 12" or "line 3 of io._rasm".
+func describeOrigin(origin srcOrigin) string {
+	description := "line " + strconv.Itoa(origin.lineNum+1)
+
+	if origin.incName != "" {
+		description += " of " + origin.incName
+	}
+
+	return description
+}
+
+// -----------------------------------------------------------------------------
+
+// formatOriginRef formats where a line of source code originates from tersely,
+// e.g. "12" or "io._rasm:3".
+func formatOriginRef(origin srcOrigin) string {
+	ref := strconv.Itoa(origin.lineNum + 1)
+
+	if origin.incName != "" {
+		ref = origin.incName + ":" + ref
+	}
+
+	return ref
+}
+
+// -----------------------------------------------------------------------------
+
+// addWarning records a warning for a line of source code.
+func (asm *assembly) addWarning(origin srcOrigin, token string, message string) {
+	warning := newAssembleError(origin, token, message)
+	warning.Warning = true
+
+	asm.warnings = append(asm.warnings, warning)
+}
+
+// -----------------------------------------------------------------------------
+
+// upgradeWarnings turns the warnings recorded so far into errors if warnings
+// are treated as errors, returning nil otherwise.
+func (asm *assembly) upgradeWarnings() error {
+	if !asm.opts.WarningsAsErrors {
+		return nil
+	}
+
+	var assembleErrs []AssembleError
+
+	for _, warning := range asm.warnings {
+		warning.Warning = false
+		assembleErrs = append(assembleErrs, warning)
+	}
+
+	asm.warnings = nil
+
+	return joinAssembleErrors(assembleErrs)
+}
+
+// -----------------------------------------------------------------------------
+
+// findColumn returns the 1-based column of a token in a raw line of source
+// code, or 0 if it cannot be found. Namespaced labels are also looked up
+// without their namespace, since that is how they usually appear in the source.
+func findColumn(rawLine string, token string) int {
+	if token == "" {
+		return 0
+	}
+
+	index := indexFold(rawLine, token)
+	if index < 0 && strings.Contains(token, namespaceDlm) {
+		index = indexFold(rawLine, strings.SplitN(token, namespaceDlm, 2)[1])
+	}
+
+	return index + 1
+}
+
+// -----------------------------------------------------------------------------
+
+// indexFold returns the byte index of the first case-insensitive occurrence of
+// a token in a line, or -1 if there is none. Unlike searching an upper-cased
+// copy of the line, the index is valid for the line itself even if upper-casing
+// would change its length, e.g. for invalid UTF-8.
+func indexFold(line string, token string) int {
+	for i := 0; i+len(token) <= len(line); i++ {
+		if strings.EqualFold(line[i:i+len(token)], token) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// -----------------------------------------------------------------------------
+
+// rawToken returns a token as it is spelled in a raw line of source code, e.g.
+// without the namespace added to labels, or the token itself if not found.
+func rawToken(rawLine string, token string) string {
+	column := findColumn(rawLine, token)
+	if column == 0 {
+		return token
+	}
+
+	rawLength := len(token)
+	if indexFold(rawLine[column-1:], token) != 0 {
+		rawLength = len(strings.SplitN(token, namespaceDlm, 2)[1])
+	}
+
+	return rawLine[column-1 : column-1+rawLength]
+}
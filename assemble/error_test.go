@@ -0,0 +1,62 @@
+/*
+Copyright 2018-2019 Juan Irming
+
+This file is part of rasm16.
+
+rasm16 is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+rasm16 is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with rasm16.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package assemble
+
+import (
+	"testing"
+)
+
+// -----------------------------------------------------------------------------
+
+// TestErrorLocation assembles source code with a bad line in the main source
+// file and in an include file, and verifies where the errors point to.
+func TestErrorLocation(t *testing.T) {
+	tests := []struct {
+		src []string
+		err AssembleError
+	}{
+		{
+			src: []string{"    NO", "    AD8  $1234,[GP0L]"},
+			err: AssembleError{
+				LineNum: 2,
+				Column:  10,
+				Token:   "$1234",
+				Message: "Literal $1234 does not fit in 8 bits for AD8, use AD16 instead",
+			},
+		},
+		{
+			src: []string{"    NO", "<bad_lib"},
+			err: AssembleError{
+				IncName: "testdata/bad_lib._rasm",
+				LineNum: 2,
+				Column:  3,
+				Token:   "XY",
+				Message: "Invalid mnemonic XY",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		_, _, err := assembleTest(test.src, "testdata/selftest_location.rasm", 0, DefaultOptions())
+		if assembleErr, ok := err.(AssembleError); !ok || assembleErr != test.err {
+			t.Errorf("Expected %+v, got %#v", test.err, err)
+		}
+	}
+}
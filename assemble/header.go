@@ -0,0 +1,218 @@
+/*
+Copyright 2018-2019 Juan Irming
+
+This file is part of rasm16.
+
+rasm16 is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+rasm16 is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with rasm16.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package assemble
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+)
+
+// -----------------------------------------------------------------------------
+
+// RELIC-16 binary header format versions.
+//
+// Version 0 is the original header, the magic header followed by the 16-bit
+// program offset. Later versions use a separate magic header followed by a
+// format version byte and the 16-bit program offset, with any new fields
+// appended after that. Version 2 adds the 16-bit entry point address.
+const (
+	headerVersionLegacy byte = 0
+	headerVersionEntry  byte = 2
+	headerVersionLatest byte = 2
+)
+
+// RELIC-16 versioned binary executable file magic header.
+var binVersionedMagicHeader []byte = []byte{0x12, 0x31, 0x1C, 0x1F} // 0x12311C1F == RELIC16 Format
+
+// RELIC-16 bank header magic, preceding each bank image in a banked binary,
+// followed by the 8-bit bank number and the 16-bit length of the bank image.
+var binBankMagicHeader []byte = []byte{0x12, 0x31, 0x1C, 0xBA} // 0x12311CBA == RELIC16 Bank
+
+// Binary header format version to emit.
+var HeaderVersion byte = headerVersionLegacy
+
+// Label of the routine loaders should start the program at, recorded in the
+// header, or empty to start at the program offset.
+var EntryLabel string = ""
+
+// -----------------------------------------------------------------------------
+
+// Header describes the header of a RELIC-16 binary executable.
+type Header struct {
+	Version       byte
+	ProgramOffset uint16
+	EntryPoint    uint16 // Start address, the program offset for versions without one.
+	Length        int    // Header length in bytes, i.e. where the program starts.
+}
+
+// -----------------------------------------------------------------------------
+
+// LatestHeaderVersion returns the latest binary header format version.
+func LatestHeaderVersion() byte {
+	return headerVersionLatest
+}
+
+// -----------------------------------------------------------------------------
+
+// ReadHeader parses the header of a RELIC-16 binary executable of any known
+// format version.
+func ReadHeader(bin []byte) (Header, error) {
+	var header Header
+
+	if len(bin) >= len(binMagicHeader)+2 && bytes.Equal(bin[:len(binMagicHeader)], binMagicHeader) {
+		header.Version = headerVersionLegacy
+		header.Length = len(binMagicHeader) + 2
+	} else if len(bin) >= len(binVersionedMagicHeader)+3 && bytes.Equal(bin[:len(binVersionedMagicHeader)], binVersionedMagicHeader) {
+		header.Version = bin[len(binVersionedMagicHeader)]
+		header.Length = len(binVersionedMagicHeader) + 3
+
+		if header.Version == headerVersionLegacy || header.Version > headerVersionLatest {
+			return header, errors.New("Unsupported header version " + strconv.Itoa(int(header.Version)))
+		}
+	} else {
+		return header, errors.New("Missing RELIC-16 magic header")
+	}
+
+	header.ProgramOffset = uint16(bin[header.Length-2])<<8 | uint16(bin[header.Length-1])
+	header.EntryPoint = header.ProgramOffset
+
+	if header.Version >= headerVersionEntry {
+		if len(bin) < header.Length+2 {
+			return header, errors.New("Truncated header, missing entry point")
+		}
+
+		header.EntryPoint = uint16(bin[header.Length])<<8 | uint16(bin[header.Length+1])
+		header.Length += 2
+	}
+
+	return header, nil
+}
+
+// -----------------------------------------------------------------------------
+
+// validateHeaderVersion checks whether a binary header format version can be
+// emitted.
+func validateHeaderVersion(headerVersion byte) error {
+	if headerVersion > headerVersionLatest {
+		return errors.New("Unsupported header version " + strconv.Itoa(int(headerVersion)) + ", latest is " + strconv.Itoa(int(headerVersionLatest)))
+	}
+
+	return nil
+}
+
+// -----------------------------------------------------------------------------
+
+// buildHeader constructs the binary header for a given format version. The
+// entry point is only recorded by format versions supporting it.
+func buildHeader(headerVersion byte, programOffset uint16, entryPoint uint16) []byte {
+	var header []byte
+
+	if headerVersion == headerVersionLegacy {
+		header = append(header, binMagicHeader...)
+	} else {
+		header = append(header, binVersionedMagicHeader...)
+		header = append(header, headerVersion)
+	}
+
+	header = appendUint16(header, programOffset)
+
+	if headerVersion >= headerVersionEntry {
+		header = appendUint16(header, entryPoint)
+	}
+
+	return header
+}
+
+// -----------------------------------------------------------------------------
+
+// resolveEntryPoint determines the entry point address from the entry label,
+// looking it up as is and in the namespace of the main source file, or returns
+// the program offset if there is no entry label.
+func (asm *assembly) resolveEntryPoint(labelAddresses map[string]int, srcName string, programOffset uint16) (uint16, error) {
+	if asm.opts.EntryLabel == "" {
+		return programOffset, nil
+	}
+
+	if asm.opts.HeaderVersion < headerVersionEntry {
+		return 0, errors.New("Entry point needs header version " + strconv.Itoa(int(headerVersionEntry)) + " or later")
+	}
+
+	for _, label := range []string{asm.opts.EntryLabel, getNamespace(srcName) + namespaceDlm + asm.opts.EntryLabel} {
+		if address, exists := labelAddresses[label]; exists {
+			return uint16(address), nil
+		}
+	}
+
+	return 0, errors.New("Entry point label " + asm.opts.EntryLabel + " not defined")
+}
+
+// -----------------------------------------------------------------------------
+
+// buildBankHeader constructs the header preceding a bank image.
+func buildBankHeader(bank byte, length int) []byte {
+	var header []byte
+
+	header = append(header, binBankMagicHeader...)
+	header = append(header, bank)
+
+	return appendUint16(header, uint16(length))
+}
+
+// -----------------------------------------------------------------------------
+
+// SplitBanks breaks down a banked RELIC-16 binary executable into standalone
+// binary executables, one per bank, each with a copy of the main header. A
+// binary without banks is returned as is, as bank 0. Any build-info footer is
+// dropped from banked binaries.
+func SplitBanks(bin []byte) (map[byte][]byte, error) {
+	header, err := ReadHeader(bin)
+	if err != nil {
+		return nil, err
+	}
+
+	rest := bin[header.Length:]
+
+	if !bytes.HasPrefix(rest, binBankMagicHeader) {
+		return map[byte][]byte{0: bin}, nil
+	}
+
+	banks := make(map[byte][]byte)
+
+	bankHeaderLength := len(binBankMagicHeader) + 3
+
+	for len(rest) >= bankHeaderLength && bytes.HasPrefix(rest, binBankMagicHeader) {
+		bank := rest[len(binBankMagicHeader)]
+		length := int(rest[len(binBankMagicHeader)+1])<<8 | int(rest[len(binBankMagicHeader)+2])
+
+		if len(rest) < bankHeaderLength+length {
+			return nil, errors.New("Truncated bank " + strconv.Itoa(int(bank)))
+		}
+
+		bankBin := buildHeader(header.Version, header.ProgramOffset, header.EntryPoint)
+		bankBin = append(bankBin, rest[bankHeaderLength:bankHeaderLength+length]...)
+
+		banks[bank] = bankBin
+
+		rest = rest[bankHeaderLength+length:]
+	}
+
+	return banks, nil
+}
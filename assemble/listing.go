@@ -0,0 +1,87 @@
+/*
+Copyright 2018-2019 Juan Irming
+
+This file is part of rasm16.
+
+rasm16 is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+rasm16 is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with rasm16.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package assemble
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// -----------------------------------------------------------------------------
+
+// Whether to build a listing during assembly.
+var BuildListing bool = false
+
+// Whether to include estimated cycle counts in the listing.
+var ListCycles bool = false
+
+// Listing built during the most recent assembly, one line per element.
+var Listing []string
+
+// -----------------------------------------------------------------------------
+
+// buildListing builds a listing of structured binary source code, showing the
+// address, bytes and original source code of every line, and optionally its
+// estimated cycle count along with a running total. Lines from include files
+// are marked with their origin, e.g. [inc io._rasm:3]. Note directives show
+// their text as a comment.
+func (asm *assembly) buildListing(srcLines []srcLine) []string {
+	var listing []string
+
+	totalCycles := 0
+
+	for _, srcLine := range srcLines {
+		address := strings.ToUpper(fmt.Sprintf("%04x", srcLine.address))
+
+		for _, label := range getLineLabels(srcLine) {
+			listing = append(listing, address+"\t\t"+label)
+		}
+
+		if srcLine.mnemonic == endOfSrcMnemonic {
+			continue
+		}
+
+		if srcLine.mnemonic == noteToken {
+			listing = append(listing, address+"\t\t"+asm.opts.CommentChar+" "+srcLine.data[1:len(srcLine.data)-1])
+
+			continue
+		}
+
+		listingLine := address + "\t" + formatBytes(srcLine.bin)
+
+		if asm.opts.ListCycles {
+			cycles := mnemonicCycles[srcLine.mnemonic]
+			totalCycles += cycles
+
+			listingLine += "\t" + strconv.Itoa(cycles) + "\t" + strconv.Itoa(totalCycles)
+		}
+
+		listingLine += "\t" + strings.TrimSpace(srcLine.rawLine)
+
+		if srcLine.incName != "" {
+			listingLine += "\t[inc " + formatOriginRef(srcLine.srcOrigin) + "]"
+		}
+
+		listing = append(listing, listingLine)
+	}
+
+	return listing
+}
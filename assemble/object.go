@@ -0,0 +1,308 @@
+/*
+Copyright 2018-2019 Juan Irming
+
+This file is part of rasm16.
+
+rasm16 is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+rasm16 is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with rasm16.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package assemble
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// -----------------------------------------------------------------------------
+
+// Object file format identifier.
+const objectFormat string = "rasm16-object-1"
+
+// Object describes a separately assembled, relocatable piece of code. All
+// addresses are relative to the start of the object's code.
+type Object struct {
+	Format      string
+	SrcName     string
+	Code        []byte
+	Symbols     map[string]uint16 // Labels defined in the object, exported ones also by name.
+	Relocations []Relocation
+}
+
+// Relocation describes a 16-bit value in an object's code that has to be fixed
+// up once the object's final address is known.
+type Relocation struct {
+	Offset uint16 // Position of the 16-bit value within the code.
+	Symbol string // Label defined in another object, empty for local addresses.
+}
+
+// -----------------------------------------------------------------------------
+
+// RawObject assembles source code into a relocatable object, like Raw does for
+// binaries. Labels not defined in the source code, as well as external labels
+// not exported by the source code itself, are left for the linker to resolve by
+// their name without the object's namespace, against the labels other objects
+// export.
+func RawObject(rawSrcLines []string, srcName string) (Object, error) {
+	asm := newAssembly(currentOptions())
+	asm.object = true
+	defer func() { Warnings = asm.warnings }()
+
+	object := Object{Format: objectFormat, SrcName: srcName}
+
+	srcLines, programOffset, err := asm.buildAddressedSrc([][]string{rawSrcLines}, []string{srcName}, 0)
+	if err != nil {
+		return object, err
+	}
+
+	if programOffset != 0 {
+		return object, errors.New(orgToken + " is not supported in object files")
+	}
+
+	if isBanked(srcLines) {
+		return object, errors.New("Bank directives are not supported in object files")
+	}
+
+	for _, srcLine := range srcLines {
+		if srcLine.mnemonic == alignToken {
+			return object, errors.New(alignToken + " is not supported in object files")
+		}
+	}
+
+	labelAddresses := getLabelAddresses(srcLines)
+
+	srcLines, object.Relocations, err = asm.expandObjectLabels(srcLines, labelAddresses, getNamespace(srcName))
+	if err != nil {
+		return object, err
+	}
+	printStructSrc("Expanded labels", srcLines)
+
+	_, err = asm.validateDataDirectives(srcLines)
+	if err != nil {
+		return object, err
+	}
+
+	_, err = asm.validateOps(srcLines)
+	if err != nil {
+		return object, err
+	}
+
+	err = asm.upgradeWarnings()
+	if err != nil {
+		return object, err
+	}
+
+	srcLines = asm.buildBinSrcLines(srcLines)
+	printStructSrc("Built structured binary", srcLines)
+
+	for _, srcLine := range srcLines {
+		object.Code = append(object.Code, srcLine.bin...)
+	}
+
+	object.Symbols = make(map[string]uint16)
+	for label, address := range labelAddresses {
+		object.Symbols[label] = uint16(address)
+	}
+
+	for name, label := range asm.exports {
+		if address, exists := labelAddresses[label]; exists {
+			object.Symbols[name] = uint16(address)
+		}
+	}
+
+	return object, nil
+}
+
+// -----------------------------------------------------------------------------
+
+// expandObjectLabels translates source labels into object-relative addresses,
+// or into placeholders for labels defined elsewhere, recording a relocation for
+// each. Labels defined elsewhere lose the object's namespace.
+func (asm *assembly) expandObjectLabels(srcLines []srcLine, labelAddresses map[string]int, namespace string) ([]srcLine, []Relocation, error) {
+	var expandedSrcLines []srcLine
+	var relocations []Relocation
+
+	expandLabel := func(label string, offset int) string {
+		address, exists := labelAddresses[label]
+		if exists {
+			relocations = append(relocations, Relocation{Offset: uint16(offset)})
+		} else {
+			relocations = append(relocations, Relocation{Offset: uint16(offset), Symbol: strings.TrimPrefix(label, namespace+namespaceDlm)})
+		}
+
+		return strings.ToUpper(fmt.Sprintf("%04x", address))
+	}
+
+	for _, srcLine := range srcLines {
+		currentSrcLine := srcLine
+
+		if label := asm.getOpLabel(srcLine.op1); srcLine.op1Type == relativeOp && label != "" {
+			if _, exists := labelAddresses[label]; !exists {
+				return nil, nil, newAssembleError(srcLine.srcOrigin, label, "Relative target "+label+" must be defined in the same object")
+			}
+
+			offset, err := getRelativeOffset(srcLine, labelAddresses[label])
+			if err != nil {
+				return nil, nil, err
+			}
+
+			currentSrcLine.op1 = asm.replaceOpLabel(srcLine.op1, offset)
+		} else if label := asm.getOpLabel(srcLine.op1); srcLine.op1 != "" && label != "" {
+			currentSrcLine.op1 = asm.replaceOpLabel(srcLine.op1, expandLabel(label, srcLine.address+1))
+		}
+
+		if label := asm.getOpLabel(srcLine.op2); srcLine.op2 != "" && label != "" {
+			currentSrcLine.op2 = asm.replaceOpLabel(srcLine.op2, expandLabel(label, srcLine.address+3))
+		}
+
+		if srcLine.mnemonic == directiveTokens[data16BitDirective] {
+			splitData := asm.splitDataValues(srcLine.data)
+
+			for i, data := range splitData {
+				cleanData := strings.TrimSpace(data)
+
+				if asm.isSrcLabel(cleanData) && !is16BitHexString(cleanData) {
+					splitData[i] = expandLabel(cleanData, srcLine.address+2*i)
+				}
+			}
+
+			currentSrcLine.data = strings.Join(splitData, asm.opts.DataDlm)
+		}
+
+		if isValidDataDirective(srcLine.mnemonic) {
+			expandedData, _, err := asm.expandDataLabels(currentSrcLine, labelAddresses)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			currentSrcLine.data = expandedData
+		}
+
+		expandedSrcLines = append(expandedSrcLines, currentSrcLine)
+	}
+
+	return expandedSrcLines, relocations, nil
+}
+
+// -----------------------------------------------------------------------------
+
+// Link places objects one after another starting at the program offset,
+// resolves labels across objects, fixes up all relocations and returns the
+// final binary executable.
+func Link(objects []Object, programOffset uint16) ([]byte, error) {
+	asm := newAssembly(currentOptions())
+
+	err := validateOptions(asm.opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var bases []int
+	symbols := make(map[string]int)
+	symbolSrcNames := make(map[string]string)
+
+	base := int(programOffset)
+
+	for _, object := range objects {
+		bases = append(bases, base)
+
+		for label, address := range object.Symbols {
+			if otherSrcName, exists := symbolSrcNames[label]; exists {
+				return nil, errors.New("Duplicate label " + label + " in " + otherSrcName + " and " + object.SrcName)
+			}
+
+			symbols[label] = base + int(address)
+			symbolSrcNames[label] = object.SrcName
+		}
+
+		base += len(object.Code)
+		if base > asm.target.maxAddressSpace {
+			return nil, errors.New(object.SrcName + ": " + asm.describeOverflow(base-int(programOffset), programOffset))
+		}
+	}
+
+	var srcName string
+	if len(objects) > 0 {
+		srcName = objects[0].SrcName
+	}
+
+	entryPoint, err := asm.resolveEntryPoint(symbols, srcName, programOffset)
+	if err != nil {
+		return nil, err
+	}
+
+	bin := buildHeader(asm.opts.HeaderVersion, programOffset, entryPoint)
+
+	for objectNum, object := range objects {
+		code := append([]byte{}, object.Code...)
+
+		for _, relocation := range object.Relocations {
+			offset := int(relocation.Offset)
+			if offset+2 > len(code) {
+				return nil, errors.New(object.SrcName + ": Invalid relocation offset " + strconv.Itoa(offset))
+			}
+
+			value := bases[objectNum] + (int(code[offset])<<8 | int(code[offset+1]))
+
+			if relocation.Symbol != "" {
+				address, exists := symbols[relocation.Symbol]
+				if !exists {
+					return nil, errors.New(object.SrcName + ": Label " + relocation.Symbol + " not defined")
+				}
+
+				value = address
+			}
+
+			code[offset], code[offset+1] = splitUint16(uint16(value))
+		}
+
+		bin = append(bin, code...)
+	}
+
+	bin, err = asm.finishBin(bin)
+	if err != nil {
+		return nil, err
+	}
+
+	printBin("Linked final binary", bin)
+
+	return bin, nil
+}
+
+// -----------------------------------------------------------------------------
+
+// EncodeObject serializes an object for writing to disk.
+func EncodeObject(object Object) ([]byte, error) {
+	return json.MarshalIndent(object, "", "\t")
+}
+
+// -----------------------------------------------------------------------------
+
+// DecodeObject deserializes an object read from disk.
+func DecodeObject(data []byte) (Object, error) {
+	var object Object
+
+	err := json.Unmarshal(data, &object)
+	if err != nil {
+		return object, err
+	}
+
+	if object.Format != objectFormat {
+		return object, errors.New("Unsupported object format " + object.Format)
+	}
+
+	return object, nil
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2018-2019 Juan Irming
+
+This file is part of rasm16.
+
+rasm16 is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+rasm16 is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with rasm16.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package assemble
+
+import (
+	"bytes"
+	"testing"
+)
+
+// -----------------------------------------------------------------------------
+
+// TestLink assembles two source files into objects, one calling a label the
+// other exports, links them and compares the result with the binary of the two
+// source files assembled together. The calling source file declares the label
+// external, or leaves it undefined.
+func TestLink(t *testing.T) {
+	srcNames := []string{"prog_main.rasm", "prog_lib.rasm"}
+
+	mainSrc := []string{
+		"EXTERN print_text",
+		"start_here",
+		"    JS   $print_text",
+		"    JM   $start_here",
+		"    $16  print_text,start_here",
+	}
+
+	libSrc := []string{
+		"GLOBAL print_text",
+		"print_text",
+		"    CO   $message,[GP0]",
+		"    RT   $[NULL]",
+		"message",
+		`    $8   "Hi"`,
+	}
+
+	expected, err := newAssembly(DefaultOptions()).assembleFiles([][]string{mainSrc, libSrc}, srcNames, 0x3000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	libObject, err := RawObject(libSrc, srcNames[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, src := range [][]string{mainSrc, mainSrc[1:]} {
+		mainObject, err := RawObject(src, srcNames[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		bin, err := Link([]Object{mainObject, libObject}, 0x3000)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(bin, expected) {
+			t.Errorf("Linked binary mismatch, expected %v, got %v", formatBytes(expected), formatBytes(bin))
+		}
+
+		_, err = Link([]Object{mainObject}, 0x3000)
+		if err == nil || err.Error() != "prog_main.rasm: Label print_text not defined" {
+			t.Errorf("Expected undefined external label error, got %v", err)
+		}
+	}
+}
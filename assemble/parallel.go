@@ -0,0 +1,77 @@
+/*
+Copyright 2018-2019 Juan Irming
+
+This file is part of rasm16.
+
+rasm16 is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+rasm16 is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with rasm16.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package assemble
+
+import (
+	"sync"
+)
+
+// -----------------------------------------------------------------------------
+
+// Input describes an independent source file to assemble with RawParallel.
+type Input struct {
+	Src           []string
+	SrcName       string
+	ProgramOffset uint16
+	Options       *Options // Assembly options, those of the package variables if nil.
+}
+
+// Result holds the outcome of assembling one Input.
+type Result struct {
+	Bin      []byte
+	Warnings []AssembleError
+	Err      error
+}
+
+// -----------------------------------------------------------------------------
+
+// RawParallel assembles independent source files concurrently, like Raw does
+// for each of them, and returns their results in the order of the inputs.
+// Unlike Raw, it does not touch Warnings, Listing, Xref or RelocOffsets.
+func RawParallel(inputs []Input) []Result {
+	results := make([]Result, len(inputs))
+
+	pkgOpts := currentOptions()
+
+	var wg sync.WaitGroup
+
+	for inputNum, input := range inputs {
+		wg.Add(1)
+
+		go func(inputNum int, input Input) {
+			defer wg.Done()
+
+			opts := pkgOpts
+			if input.Options != nil {
+				opts = *input.Options
+			}
+
+			asm := newAssembly(opts)
+
+			bin, err := asm.assembleFiles([][]string{input.Src}, []string{input.SrcName}, input.ProgramOffset)
+
+			results[inputNum] = Result{Bin: bin, Warnings: asm.warnings, Err: err}
+		}(inputNum, input)
+	}
+
+	wg.Wait()
+
+	return results
+}
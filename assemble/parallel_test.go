@@ -0,0 +1,100 @@
+/*
+Copyright 2018-2019 Juan Irming
+
+This file is part of rasm16.
+
+rasm16 is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+rasm16 is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with rasm16.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package assemble
+
+import (
+	"reflect"
+	"testing"
+)
+
+// -----------------------------------------------------------------------------
+
+// TestRawParallel assembles all test programs concurrently and compares each
+// result with the expected one, verifying that concurrent assemblies do not
+// affect each other.
+func TestRawParallel(t *testing.T) {
+	programs := getAllTestPrograms()
+
+	var inputs []Input
+	for _, program := range programs {
+		opts := getTestOptions(program.commentChar)
+
+		inputs = append(inputs, Input{Src: program.src, SrcName: program.srcName, ProgramOffset: program.offset, Options: &opts})
+	}
+
+	for programNum, result := range RawParallel(inputs) {
+		err := result.Err
+		if err == nil {
+			err = checkTestProgram(programs[programNum], result.Bin, result.Warnings)
+		}
+
+		if err != nil {
+			t.Error(programs[programNum].srcName + ": " + err.Error())
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// TestRawParallelOptions assembles every test program several times
+// concurrently with differing options and compares each result with that of
+// assembling it on its own. Run with -race to catch shared state.
+func TestRawParallelOptions(t *testing.T) {
+	optsVariants := []func(opts *Options){
+		func(opts *Options) {},
+		func(opts *Options) {
+			opts.Target = "relic16-32k"
+			opts.HeaderVersion = headerVersionLatest
+		},
+		func(opts *Options) {
+			opts.WarningsAsErrors = true
+			opts.MaxExpandedLines = 16
+		},
+		func(opts *Options) {
+			opts.ExplicitOffset = true
+			opts.Charset = builtinCharsets["screencode"]
+			opts.PadSize = 0x100
+			opts.BuildInfo = "rasm16 test"
+		},
+	}
+
+	var inputs []Input
+	var expected []Result
+
+	for round := 0; round < 4; round++ {
+		for _, program := range getAllTestPrograms() {
+			for _, optsVariant := range optsVariants {
+				opts := getTestOptions(program.commentChar)
+				optsVariant(&opts)
+
+				bin, asm, err := assembleTest(program.src, program.srcName, program.offset, opts)
+
+				inputs = append(inputs, Input{Src: program.src, SrcName: program.srcName, ProgramOffset: program.offset, Options: &opts})
+				expected = append(expected, Result{Bin: bin, Warnings: asm.warnings, Err: err})
+			}
+		}
+	}
+
+	for inputNum, result := range RawParallel(inputs) {
+		if !reflect.DeepEqual(result, expected[inputNum]) {
+			t.Errorf("%s with options %+v: got %v, %v, expected %v, %v", inputs[inputNum].SrcName, *inputs[inputNum].Options, result.Bin, result.Err, expected[inputNum].Bin, expected[inputNum].Err)
+		}
+	}
+}
@@ -22,8 +22,11 @@ package assemble
 import (
 	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
 	"rasm/file"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -35,14 +38,82 @@ const (
 	constStartToken string = "["
 	incToken        string = "<"
 	dataLineToken   string = "$"
+	redefineToken   string = "#redefine"
+	pragmaToken     string = "#pragma"
+	quotedIncToken  string = "#include"
+	continueToken   string = `\`
+	labelEndToken   string = ":"
 )
 
+// Arithmetic operators allowed in preprocessor constant definitions and in
+// expressions on preprocessor constants elsewhere.
+const constOperators string = "+-*/"
+
+// Name prefix of the built-in interrupt vector preprocessor constants.
+const irqConstPrefix string = "[IRQ"
+
+// Pragma name definitions.
+const (
+	offsetPragma string = "offset"
+)
+
+// Symbol directive tokens, exporting a label to all source/include files and
+// declaring a label exported elsewhere, respectively.
+const (
+	globalToken string = "GLOBAL"
+	externToken string = "EXTERN"
+)
+
+// Value directive token, naming a 16-bit value like a label names an address,
+// e.g. SPEED EQU 0010.
+const equToken string = "EQU"
+
+// Built-in, per-line preprocessor constant definitions, expanding to the
+// original line number as a 16-bit hexadecimal value and to the name of the
+// originating source/include file as a data string, respectively.
+const (
+	lineConstToken string = "__LINE__"
+	fileConstToken string = "__FILE__"
+)
+
+// Preprocessor directive tokens, which are never treated as comments.
+var preprocessorTokens = []string{redefineToken, pragmaToken, quotedIncToken}
+
+// Default comment character, also used by self-test programs.
+const defaultCommentChar string = "#"
+
+// Comment character, starting a comment that runs to the end of the line.
+var CommentChar string = defaultCommentChar
+
 // Namespace delimiter definition.
 const namespaceDlm string = "."
 
-// Built-in, immutable preprocessor constant definitions.
-var defaultConsts = map[string]string{
-	// Special Addresses
+// Include chain delimiter definition, used in error messages.
+const incChainDlm string = " -> "
+
+// Default maximum include file nesting depth.
+const defaultMaxIncDepth int = 16
+
+// Maximum include file nesting depth, see defaultMaxIncDepth.
+var MaxIncDepth int = defaultMaxIncDepth
+
+// Default maximum number of source lines after adding include files and
+// expanding data null repeats, each repeated null value counting as a line.
+// Guards against runaway expansion.
+const defaultMaxExpandedLines int = 250000
+
+// Maximum number of expanded source lines, see defaultMaxExpandedLines.
+var MaxExpandedLines int = defaultMaxExpandedLines
+
+// Directories searched for include files not found next to the including file.
+var IncDirs []string
+
+// Whether preprocessor constants defined in include files are namespaced like
+// labels, e.g. [PORT] defined in regs._rasm becomes [regs.PORT].
+var NamespaceIncConsts bool = false
+
+// Built-in, immutable special address preprocessor constant definitions.
+var specialAddressConsts = map[string]string{
 	"[SP]":   "FFB0", // Stack Pointer
 	"[IO]":   "FFB2", // Subroutine I/O
 	"[PC]":   "FFB4", // Program Counter
@@ -91,8 +162,10 @@ var defaultConsts = map[string]string{
 	"[GP6L]": "FFFD", // GENERAL6 LOW BYTE
 	"[GP7]":  "FFFE", // GENERAL7
 	"[GP7L]": "FFFF", // GENERAL7 LOW BYTE
+}
 
-	// Magic Values
+// Built-in, immutable magic value preprocessor constant definitions.
+var magicValueConsts = map[string]string{
 	"[TRUE]":  "0001",
 	"[FALSE]": "FFFF",
 	"[NULL]":  "0000",
@@ -100,17 +173,82 @@ var defaultConsts = map[string]string{
 
 // -----------------------------------------------------------------------------
 
-// cleanSrc removes comments and extraneous whitespace from the source code.
-func cleanSrc(srcLines []string) []string {
+// mergeConsts combines several preprocessor constant maps into a new one.
+func mergeConsts(constMaps ...map[string]string) map[string]string {
+	consts := make(map[string]string)
+
+	for _, constMap := range constMaps {
+		for constName, constValue := range constMap {
+			consts[constName] = constValue
+		}
+	}
+
+	return consts
+}
+
+// -----------------------------------------------------------------------------
+
+// PrintConsts outputs all built-in preprocessor constants of the selected target
+// memory profile and their values, grouped into special addresses and magic
+// values.
+func PrintConsts() {
+	fmt.Println("Special addresses")
+	printConstMap(targetProfiles[Target].specialAddressConsts)
+
+	fmt.Println()
+
+	fmt.Println("Magic values")
+	printConstMap(magicValueConsts)
+
+	fmt.Println()
+
+	fmt.Println("Per-line values")
+	fmt.Println(lineConstToken + "\tcurrent line number")
+	fmt.Println(fileConstToken + "\tcurrent file name, as a string")
+}
+
+// -----------------------------------------------------------------------------
+
+// printConstMap outputs preprocessor constants sorted by value, then by name.
+func printConstMap(consts map[string]string) {
+	var constNames []string
+
+	for constName := range consts {
+		constNames = append(constNames, constName)
+	}
+
+	sort.Slice(constNames, func(i, j int) bool {
+		if consts[constNames[i]] != consts[constNames[j]] {
+			return consts[constNames[i]] < consts[constNames[j]]
+		}
+
+		return constNames[i] < constNames[j]
+	})
+
+	for _, constName := range constNames {
+		fmt.Println(constName + "\t" + consts[constName])
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// cleanSrc removes comments and extraneous whitespace from the source code,
+// turning any run of whitespace into a single space. Comment characters and
+// whitespace within string or character quotes are kept, e.g. in string
+// preprocessor constants.
+func (asm *assembly) cleanSrc(srcLines []string) []string {
 	var cleanSrcLines []string
 
-	reComments := regexp.MustCompile("#.*")
-	reDoubleSpace := regexp.MustCompile(`[\s\p{Zs}]{2,}`)
+	reSpace := regexp.MustCompile(`[\s\p{Zs}]+`)
 
 	for _, srcLine := range srcLines {
-		cleanLine := reComments.ReplaceAllLiteralString(srcLine, "")
-		cleanLine = reDoubleSpace.ReplaceAllLiteralString(cleanLine, " ")
-		cleanLine = strings.TrimSpace(cleanLine)
+		directive, cleanLine := splitPreprocessorToken(srcLine)
+
+		cleanLine = splitUnquoted(cleanLine, asm.opts.CommentChar)[0]
+		cleanLine = mapUnquoted(cleanLine, func(s string) string {
+			return reSpace.ReplaceAllLiteralString(s, " ")
+		})
+		cleanLine = strings.TrimSpace(directive + cleanLine)
 
 		cleanSrcLines = append(cleanSrcLines, cleanLine)
 	}
@@ -120,31 +258,137 @@ func cleanSrc(srcLines []string) []string {
 
 // -----------------------------------------------------------------------------
 
-// expandConsts translates preprocessor constants to their values.
-func expandConsts(srcLines []string) ([]string, error) {
+// joinContinuedLines joins every line of cleaned source code ending with the
+// continue token outside of string and character quotes with the line after
+// it, e.g. $8 01,02, \ continued by 03. The joined line takes the place of the
+// first line, keeping its origin, and the continuation lines become empty. A
+// continue token within quotes is part of the string, so strings cannot span
+// lines.
+func (asm *assembly) joinContinuedLines(srcLines []string, origins []srcOrigin) ([]string, error) {
+	joinedSrcLines := append([]string{}, srcLines...)
+
+	firstLineNum := -1
+
+	for lineNum, srcLine := range srcLines {
+		if firstLineNum >= 0 {
+			joinedLine := joinedSrcLines[firstLineNum]
+			if srcLine != "" && !strings.HasSuffix(joinedLine, opDlm) && !strings.HasSuffix(joinedLine, asm.opts.DataDlm) && !strings.HasPrefix(srcLine, opDlm) && !strings.HasPrefix(srcLine, asm.opts.DataDlm) {
+				joinedLine += " "
+			}
+
+			joinedSrcLines[firstLineNum] = joinedLine + srcLine
+			joinedSrcLines[lineNum] = ""
+		} else {
+			firstLineNum = lineNum
+		}
+
+		if !isContinued(joinedSrcLines[firstLineNum]) {
+			firstLineNum = -1
+
+			continue
+		}
+
+		joinedSrcLines[firstLineNum] = strings.TrimSpace(strings.TrimSuffix(joinedSrcLines[firstLineNum], continueToken))
+	}
+
+	if firstLineNum >= 0 {
+		return nil, newAssembleError(origins[firstLineNum], continueToken, "Line continuation "+continueToken+" without a following line")
+	}
+
+	return joinedSrcLines, nil
+}
+
+// -----------------------------------------------------------------------------
+
+// isContinued checks whether a line of cleaned source code ends with the
+// continue token outside of string and character quotes.
+func isContinued(srcLine string) bool {
+	splitLine := splitUnquoted(srcLine, continueToken)
+
+	return len(splitLine) > 1 && splitLine[len(splitLine)-1] == ""
+}
+
+// -----------------------------------------------------------------------------
+
+// splitInlineLabels moves labels ending with the label end token off the line
+// of source code they precede onto a line of their own, e.g. table: .align 10
+// becomes table followed by .align 10. Both lines keep the original origin.
+func (asm *assembly) splitInlineLabels(srcLines []string, origins []srcOrigin) ([]string, []srcOrigin) {
+	var splitSrcLines []string
+	var splitOrigins []srcOrigin
+
+	reInlineLabel := regexp.MustCompile(`^(` + asm.getSrcLabelPattern() + `)` + regexp.QuoteMeta(labelEndToken) + `(?: |$)`)
+
+	for lineNum, srcLine := range srcLines {
+		if match := reInlineLabel.FindStringSubmatch(srcLine); match != nil {
+			splitSrcLines = append(splitSrcLines, match[1])
+			splitOrigins = append(splitOrigins, origins[lineNum])
+
+			srcLine = srcLine[len(match[0]):]
+		}
+
+		splitSrcLines = append(splitSrcLines, srcLine)
+		splitOrigins = append(splitOrigins, origins[lineNum])
+	}
+
+	return splitSrcLines, splitOrigins
+}
+
+// -----------------------------------------------------------------------------
+
+// splitPreprocessorToken separates a leading preprocessor directive token, if
+// any, from the rest of a line of source code.
+func splitPreprocessorToken(srcLine string) (string, string) {
+	trimmedLine := strings.TrimSpace(srcLine)
+
+	for _, token := range preprocessorTokens {
+		if strings.HasPrefix(trimmedLine, token+" ") || strings.HasPrefix(trimmedLine, token+"\t") {
+			return token, trimmedLine[len(token):]
+		}
+	}
+
+	return "", srcLine
+}
+
+// -----------------------------------------------------------------------------
+
+// expandConsts translates preprocessor constants to their values. The name of
+// the source/include file is used for per-line constants.
+func (asm *assembly) expandConsts(srcLines []string, origins []srcOrigin, srcName string) ([]string, error) {
 	var expandedSrcLines []string
 	var expandedLine string
 
-	expandedConsts, err := getConsts(srcLines)
+	expandedConsts, err := asm.getConsts(srcLines, origins)
 	if err != nil {
 		return nil, err
 	}
 
-	reConstName := regexp.MustCompile(`\[.+\]`)
+	reConstName := regexp.MustCompile(`\[.+?\]`)
+	reConstExpr := regexp.MustCompile(getConstExprPattern())
+
+	constNames := getSortedConstNames(expandedConsts)
+
+	var undefinedErrs []AssembleError
 
 	for lineNum, srcLine := range srcLines {
 		expandedLine = srcLine
 
 		if srcLine != "" {
-			if srcLine[:1] != constStartToken {
-				for constName, constValue := range expandedConsts {
-					expandedLine = strings.Replace(expandedLine, constName, constValue, -1)
+			if firstChar(srcLine) != constStartToken && !strings.HasPrefix(srcLine, redefineToken+" "+constStartToken) {
+				// References are checked as written, since expanded values
+				// may contain brackets themselves.
+				undefinedErrs = append(undefinedErrs, getUndefinedConstErrs(findAllUnquoted(reConstName, srcLine), expandedConsts, origins[lineNum], asm.opts.NamespaceIncConsts)...)
+
+				expandedLine, err = asm.evalLineConstExprs(expandedLine, reConstExpr, expandedConsts, constNames, origins[lineNum])
+				if err != nil {
+					return nil, err
 				}
 
-				foundUnmatched := reConstName.FindString(expandedLine)
-				if foundUnmatched != "" {
-					return nil, errors.New(strconv.Itoa(lineNum+1) + ": Preprocessor constant " + foundUnmatched + " not defined")
+				for _, constName := range constNames {
+					expandedLine = strings.Replace(expandedLine, constName, expandedConsts[constName], -1)
 				}
+
+				expandedLine = expandLineConsts(expandedLine, origins[lineNum], srcName)
 			} else {
 				expandedLine = ""
 			}
@@ -153,37 +397,207 @@ func expandConsts(srcLines []string) ([]string, error) {
 		expandedSrcLines = append(expandedSrcLines, expandedLine)
 	}
 
+	if len(undefinedErrs) > 0 {
+		return nil, joinAssembleErrors(undefinedErrs)
+	}
+
 	return expandedSrcLines, nil
 }
 
 // -----------------------------------------------------------------------------
 
-// getConsts finds non-default preprocessor constants in the source code.
-func getConsts(srcLines []string) (map[string]string, error) {
-	consts := defaultConsts
+// getConstExprPattern returns the regular expression matching arithmetic on
+// preprocessor constants and 16-bit hexadecimal values, e.g. [IRQ0]+2*3.
+func getConstExprPattern() string {
+	return getExprPattern(`(?:\[[^\]\s]+\]|\b[0-9A-Fa-f]{1,4}\b)`)
+}
+
+// -----------------------------------------------------------------------------
 
-	reConstName := regexp.MustCompile(`\[.+\]`)
-	reConstValue := regexp.MustCompile(`\].+`)
+// getExprPattern returns the regular expression matching arithmetic on terms
+// matched by the given regular expression.
+func getExprPattern(term string) string {
+	var operators string
+	for _, operator := range constOperators {
+		operators += `\` + string(operator)
+	}
+
+	return term + `(?: ?[` + operators + `] ?` + term + `)+`
+}
+
+// -----------------------------------------------------------------------------
+
+// evalLineConstExprs evaluates arithmetic on preprocessor constants in operands
+// and data on a line of source code, replacing each expression with its result.
+// Only expressions involving at least one constant whose value is a 16-bit
+// hexadecimal value are evaluated. Results in 8-bit data directives take two
+// digits where they fit. Expressions on interrupt vector constants resulting in
+// an odd, i.e. misaligned, address cause a warning.
+func (asm *assembly) evalLineConstExprs(srcLine string, reConstExpr *regexp.Regexp, consts map[string]string, constNames []string, origin srcOrigin) (string, error) {
+	var exprErr error
+
+	instrs := splitUnquoted(srcLine, asm.opts.InstrDlm)
+
+	for i, instr := range instrs {
+		fields := strings.Fields(instr)
+		is8BitData := len(fields) > 0 && fields[0] == directiveTokens[data8BitDirective]
+
+		instrs[i] = mapUnquoted(instr, func(s string) string {
+			return reConstExpr.ReplaceAllStringFunc(s, func(expr string) string {
+				if exprErr != nil || !strings.Contains(expr, constStartToken) {
+					return expr
+				}
+
+				value := expr
+				for _, constName := range constNames {
+					value = strings.Replace(value, constName, consts[constName], -1)
+				}
+
+				result, err := evalConstExpr(value)
+				if err != nil {
+					exprErr = newAssembleError(origin, expr, err.Error()+" in expression "+expr)
+
+					return expr
+				}
+
+				if address, _ := strconv.ParseUint(result, 16, 16); address%2 != 0 && asm.hasIrqConst(expr) {
+					asm.addWarning(origin, expr, "Interrupt vector expression "+expr+" results in misaligned address "+result)
+				}
+
+				if is8BitData && len(result) == 4 && strings.HasPrefix(result, "00") {
+					result = result[2:]
+				}
+
+				return result
+			})
+		})
+	}
+
+	return strings.Join(instrs, asm.opts.InstrDlm), exprErr
+}
+
+// -----------------------------------------------------------------------------
+
+// hasIrqConst checks whether an expression references one of the built-in
+// interrupt vector preprocessor constants.
+func (asm *assembly) hasIrqConst(expr string) bool {
+	for constName := range asm.target.defaultConsts {
+		if strings.HasPrefix(constName, irqConstPrefix) && strings.Contains(expr, constName) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// -----------------------------------------------------------------------------
+
+// getUndefinedConstErrs creates an error for each distinct preprocessor
+// constant referenced on a line that is not defined, nor deferred if allowed.
+func getUndefinedConstErrs(constNames []string, consts map[string]string, origin srcOrigin, allowDeferred bool) []AssembleError {
+	var undefinedErrs []AssembleError
+
+	reported := make(map[string]bool)
+
+	for _, constName := range constNames {
+		if _, exists := consts[constName]; exists || (allowDeferred && isDeferredConst(constName)) || reported[constName] {
+			continue
+		}
+
+		undefinedErrs = append(undefinedErrs, newAssembleError(origin, constName, "Preprocessor constant "+constName+" not defined"))
+		reported[constName] = true
+	}
+
+	return undefinedErrs
+}
+
+// -----------------------------------------------------------------------------
+
+// getSortedConstNames returns the names of preprocessor constants longest first,
+// and alphabetically among names of equal length, so that expansion does not
+// depend on map order and longer names are replaced before shorter ones.
+func getSortedConstNames(consts map[string]string) []string {
+	var constNames []string
+
+	for constName := range consts {
+		constNames = append(constNames, constName)
+	}
+
+	sort.Slice(constNames, func(i, j int) bool {
+		if len(constNames[i]) != len(constNames[j]) {
+			return len(constNames[i]) > len(constNames[j])
+		}
+
+		return constNames[i] < constNames[j]
+	})
+
+	return constNames
+}
+
+// -----------------------------------------------------------------------------
+
+// expandLineConsts translates the per-line preprocessor constants in a line of
+// source code, outside of strings, based on the line's origin.
+func expandLineConsts(srcLine string, origin srcOrigin, srcName string) string {
+	lineValue := strings.ToUpper(fmt.Sprintf("%04x", origin.lineNum+1))
+
+	fileValue := strings.Replace(srcName, escapeToken, escapeToken+escapeToken, -1)
+	fileValue = strings.Replace(fileValue, srcStringToken, escapeToken+srcStringToken, -1)
+	fileValue = srcStringToken + fileValue + srcStringToken
+
+	return mapUnquoted(srcLine, func(s string) string {
+		s = strings.Replace(s, lineConstToken, lineValue, -1)
+
+		return strings.Replace(s, fileConstToken, fileValue, -1)
+	})
+}
+
+// -----------------------------------------------------------------------------
+
+// getConsts adds the non-default preprocessor constants found in the source
+// code to those of the assembly. Existing constants can only be replaced using
+// the redefine directive, in which case the last definition wins. Constants
+// defined earlier are expanded in values, and arithmetic on 16-bit hexadecimal
+// values is evaluated, e.g. [END] [BASE]+100.
+func (asm *assembly) getConsts(srcLines []string, origins []srcOrigin) (map[string]string, error) {
+	consts := asm.consts
+
+	reConstName := regexp.MustCompile(`^\[.+?\]`)
 
 	for lineNum, srcLine := range srcLines {
-		if srcLine != "" && srcLine[:1] == "[" {
+		isRedefine := strings.HasPrefix(srcLine, redefineToken)
+		if isRedefine {
+			srcLine = strings.TrimSpace(srcLine[len(redefineToken):])
+		}
+
+		if firstChar(srcLine) == constStartToken {
 			constName := reConstName.FindString(srcLine)
 
-			if _, exists := consts[constName]; exists {
-				return nil, errors.New(strconv.Itoa(lineNum+1) + ": Cannot redefine preprocessor constant " + constName)
+			if _, exists := consts[constName]; exists && !isRedefine {
+				return nil, newAssembleError(origins[lineNum], constName, "Cannot redefine preprocessor constant "+constName+" without "+redefineToken)
+			}
+
+			constValue := strings.TrimSpace(srcLine[len(constName):])
+			if constName == "" || constValue == "" {
+				return nil, newAssembleError(origins[lineNum], srcLine, "Missing value for preprocessor constant "+srcLine)
+			}
+
+			for _, otherName := range getSortedConstNames(consts) {
+				constValue = strings.Replace(constValue, otherName, consts[otherName], -1)
 			}
 
-			constValue := reConstValue.FindString(srcLine)
-			constValue = constValue[1:]
-			constValue = strings.TrimSpace(constValue)
+			constValue, err := evalConstExpr(constValue)
+			if err != nil {
+				return nil, newAssembleError(origins[lineNum], constName, err.Error()+" in preprocessor constant "+constName)
+			}
 
 			consts[constName] = constValue
 		}
 	}
 
 	if DEBUG {
-		fmt.Print("Preprocessor constants: ")
-		fmt.Println(consts)
+		fmt.Fprint(os.Stderr, "Preprocessor constants: ")
+		fmt.Fprintln(os.Stderr, consts)
 	}
 
 	return consts, nil
@@ -191,25 +605,202 @@ func getConsts(srcLines []string) (map[string]string, error) {
 
 // -----------------------------------------------------------------------------
 
+// evalConstExpr evaluates a preprocessor constant value consisting of 16-bit
+// hexadecimal values and arithmetic operators, multiplication and division
+// taking precedence, and returns the result as a 16-bit hexadecimal value. Any
+// other value, including a single hexadecimal value or a label difference such
+// as table_end-table_start, is returned unchanged.
+func evalConstExpr(value string) (string, error) {
+	reNumericExpr := regexp.MustCompile(`^` + getExprPattern(`[0-9A-Fa-f]{1,4}`) + `$`)
+	if !reNumericExpr.MatchString(value) {
+		return value, nil
+	}
+
+	expr := strings.Replace(value, " ", "", -1)
+
+	var terms []string
+	var operators []string
+
+	start := 0
+	for i := 0; i < len(expr); i++ {
+		if strings.ContainsAny(expr[i:i+1], constOperators) {
+			terms = append(terms, expr[start:i])
+			operators = append(operators, expr[i:i+1])
+			start = i + 1
+		}
+	}
+	terms = append(terms, expr[start:])
+
+	var values []int64
+	for _, term := range terms {
+		termValue, _ := strconv.ParseInt(term, 16, 32)
+		values = append(values, termValue)
+	}
+
+	// Multiplication and division first, leaving sums and differences.
+	sumValues := []int64{values[0]}
+	var sumOperators []string
+
+	for i, operator := range operators {
+		last := len(sumValues) - 1
+
+		switch operator {
+		case "*":
+			sumValues[last] *= values[i+1]
+		case "/":
+			if values[i+1] == 0 {
+				return "", errors.New("Division by zero")
+			}
+			sumValues[last] /= values[i+1]
+		default:
+			sumValues = append(sumValues, values[i+1])
+			sumOperators = append(sumOperators, operator)
+		}
+
+		if sumValues[last] > 0xFFFF {
+			return "", errors.New("Value exceeds FFFF")
+		}
+	}
+
+	result := sumValues[0]
+	for i, operator := range sumOperators {
+		if operator == "+" {
+			result += sumValues[i+1]
+		} else {
+			result -= sumValues[i+1]
+		}
+
+		if result > 0xFFFF {
+			return "", errors.New("Value exceeds FFFF")
+		} else if result < 0 {
+			return "", errors.New("Value below 0000")
+		}
+	}
+
+	return strings.ToUpper(fmt.Sprintf("%04x", result)), nil
+}
+
+// -----------------------------------------------------------------------------
+
+// isDeferredConst checks whether a preprocessor constant that is not defined
+// yet may still be defined by an include file processed later, given that
+// include file preprocessor constants are namespaced.
+func isDeferredConst(constName string) bool {
+	return strings.Contains(constName, namespaceDlm)
+}
+
+// -----------------------------------------------------------------------------
+
+// expandDeferredConsts translates namespaced include file preprocessor
+// constants that were referenced before their include file was processed.
+func (asm *assembly) expandDeferredConsts(srcLines []string, origins []srcOrigin) ([]string, error) {
+	var expandedSrcLines []string
+
+	reConstName := regexp.MustCompile(`\[.+?\]`)
+
+	var undefinedErrs []AssembleError
+
+	for lineNum, srcLine := range srcLines {
+		undefinedErrs = append(undefinedErrs, getUndefinedConstErrs(findAllUnquoted(reConstName, srcLine), asm.consts, origins[lineNum], false)...)
+
+		expandedLine := mapUnquoted(srcLine, func(s string) string {
+			return reConstName.ReplaceAllStringFunc(s, func(constName string) string {
+				if constValue, exists := asm.consts[constName]; exists {
+					return constValue
+				}
+
+				return constName
+			})
+		})
+
+		expandedSrcLines = append(expandedSrcLines, expandedLine)
+	}
+
+	if len(undefinedErrs) > 0 {
+		return nil, joinAssembleErrors(undefinedErrs)
+	}
+
+	return expandedSrcLines, nil
+}
+
+// -----------------------------------------------------------------------------
+
+// getNamespace determines the namespace for labels and constants defined in a
+// source/include file. Directories are not part of the namespace, and
+// characters not allowed in labels, e.g. spaces, become underscores.
+func getNamespace(srcName string) string {
+	reNonLabelChar := regexp.MustCompile(`[^\w]`)
+
+	return reNonLabelChar.ReplaceAllLiteralString(strings.SplitN(filepath.Base(srcName), namespaceDlm, 2)[0], "_")
+}
+
+// -----------------------------------------------------------------------------
+
+// addConstNamespaces prefixes the names of preprocessor constants defined in an
+// include file with the file's namespace, both in their definitions and in all
+// references to them within the file.
+func addConstNamespaces(srcLines []string, incName string) []string {
+	namespace := getNamespace(incName)
+
+	reConstName := regexp.MustCompile(`^\[.+?\]`)
+
+	var constNames []string
+
+	for _, srcLine := range srcLines {
+		constName := reConstName.FindString(srcLine)
+		if constName != "" && !strings.Contains(constName, namespaceDlm) {
+			constNames = append(constNames, constName)
+		}
+	}
+
+	var namespacedSrcLines []string
+
+	for _, srcLine := range srcLines {
+		namespacedLine := srcLine
+
+		for _, constName := range constNames {
+			namespacedName := constStartToken + namespace + namespaceDlm + constName[1:]
+			namespacedLine = strings.Replace(namespacedLine, constName, namespacedName, -1)
+		}
+
+		namespacedSrcLines = append(namespacedSrcLines, namespacedLine)
+	}
+
+	return namespacedSrcLines
+}
+
+// -----------------------------------------------------------------------------
+
 // addSrcLabelNamespaces prefixes source code labels with namespaces based on
 // the source/include file they occur in.
-func addSrcLabelNamespaces(srcLines []string, srcName string) []string {
-	namespace := strings.SplitN(srcName, namespaceDlm, 2)[0]
+func (asm *assembly) addSrcLabelNamespaces(srcLines []string, srcName string) []string {
+	namespace := getNamespace(srcName)
 
 	var namespacedSrcLines []string
 
-	reSrcLabel := regexp.MustCompile(`([\w.]{5,})`)
+	// Decimal data values and null repeat counts are matched along with their
+	// token to skip them.
+	reSrcLabel := regexp.MustCompile(`(` + regexp.QuoteMeta(decimalToken) + `-?|` + regexp.QuoteMeta(nullRepeatStartToken) + `)?(` + asm.getSrcLabelPattern() + `)`)
 
 	for _, srcLine := range srcLines {
 		namespacedLine := srcLine
 
-		if srcLine != "" && srcLine[:1] != incToken && srcLine[:1] != dataLineToken {
-			namespacedLine = reSrcLabel.ReplaceAllStringFunc(srcLine, func(s string) string {
-				if strings.Contains(s, namespaceDlm) {
-					return s
-				}
+		if name, value, isRedefine, isEqu := splitEquDirective(srcLine); isEqu && asm.isSrcLabel(name) && !strings.Contains(name, namespaceDlm) {
+			namespacedLine = formatEquDirective(namespace+namespaceDlm+name, value, isRedefine)
+		} else if _, isInc := splitIncLine(srcLine); srcLine != "" && !isInc && !strings.HasPrefix(srcLine, pragmaToken) {
+			directive, rest := splitSymbolDirective(srcLine)
+			if directive == "" {
+				directive, rest = splitMnemonic(srcLine)
+			}
 
-				return namespace + namespaceDlm + s
+			namespacedLine = directive + mapUnquoted(rest, func(s string) string {
+				return reSrcLabel.ReplaceAllStringFunc(s, func(s string) string {
+					if strings.Contains(s, namespaceDlm) || s == sizeSymbol || strings.HasPrefix(s, decimalToken) || strings.HasPrefix(s, nullRepeatStartToken) {
+						return s
+					}
+
+					return namespace + namespaceDlm + s
+				})
 			})
 		}
 
@@ -221,90 +812,547 @@ func addSrcLabelNamespaces(srcLines []string, srcName string) []string {
 
 // -----------------------------------------------------------------------------
 
-// addIncludes reads rasm include files referenced in the main source file,
-// processes them and returns the final, complete source code.
-func addIncludes(srcLines []string) ([]string, error) {
-	var allSrcLines []string
+// splitMnemonic separates a leading mnemonic or directive token, if any,
+// including the following space, from the rest of a line of source code, so
+// that long mnemonics are not mistaken for labels.
+func splitMnemonic(srcLine string) (string, string) {
+	splitLine := strings.SplitN(srcLine, mnemonicOpDlm, 2)
+	if len(splitLine) < 2 {
+		return "", srcLine
+	}
+
+	token := strings.ToUpper(splitLine[0])
+	if _, exists := mnemonicAliases[token]; exists {
+		token = mnemonicAliases[token]
+	}
+
+	if _, exists := mnemonics[token]; !exists {
+		return "", srcLine
+	}
+
+	return srcLine[:len(splitLine[0])+1], splitLine[1]
+}
+
+// -----------------------------------------------------------------------------
+
+// splitSymbolDirective separates a leading symbol directive token, if any,
+// including the following space, from the rest of a line of source code.
+func splitSymbolDirective(srcLine string) (string, string) {
+	for _, token := range []string{globalToken, externToken} {
+		if strings.HasPrefix(strings.ToUpper(srcLine), token+" ") {
+			return srcLine[:len(token)+1], srcLine[len(token)+1:]
+		}
+	}
+
+	return "", srcLine
+}
+
+// -----------------------------------------------------------------------------
+
+// resolveSymbolDirectives processes the symbol directives of all source and
+// include files. Every reference to a label declared external is replaced with
+// the namespaced label exported under the same name, and the directive lines
+// are blanked out. The exported labels are kept in the assembly state. When
+// assembling an object, external labels exported nowhere are replaced with
+// their name alone for the linker to resolve.
+func (asm *assembly) resolveSymbolDirectives(srcLines []string, origins []srcOrigin) ([]string, error) {
+	globalLabels := make(map[string]string)
+	externLabels := make(map[string]string)
+
+	for lineNum, srcLine := range srcLines {
+		directive, label := splitSymbolDirective(srcLine)
+		if strings.ToUpper(strings.TrimSpace(directive)) != globalToken {
+			continue
+		}
+
+		if !asm.isSrcLabel(label) {
+			return nil, newAssembleError(origins[lineNum], label, "Invalid label "+label)
+		}
+
+		name := strings.SplitN(label, namespaceDlm, 2)[1]
+
+		if otherLabel, exists := globalLabels[name]; exists {
+			return nil, newAssembleError(origins[lineNum], label, "Label "+name+" already exported as "+otherLabel)
+		}
+
+		globalLabels[name] = label
+	}
+
+	for lineNum, srcLine := range srcLines {
+		directive, label := splitSymbolDirective(srcLine)
+		if strings.ToUpper(strings.TrimSpace(directive)) != externToken {
+			continue
+		}
+
+		if !asm.isSrcLabel(label) {
+			return nil, newAssembleError(origins[lineNum], label, "Invalid label "+label)
+		}
+
+		name := strings.SplitN(label, namespaceDlm, 2)[1]
+
+		if _, exists := globalLabels[name]; !exists {
+			if asm.object {
+				externLabels[label] = name
+
+				continue
+			}
+
+			return nil, newAssembleError(origins[lineNum], label, "External label "+name+" not exported by any "+globalToken)
+		}
+
+		externLabels[label] = globalLabels[name]
+	}
+
+	var resolvedSrcLines []string
+
+	reSrcLabel := regexp.MustCompile(`(` + asm.getSrcLabelPattern() + `)`)
 
 	for _, srcLine := range srcLines {
-		if srcLine != "" && srcLine[:1] == incToken {
-			incName := srcLine[1:]
-			incName = strings.TrimSpace(incName)
-			incName += file.IncExt
+		resolvedLine := srcLine
 
-			rawIncLines, err := file.ReadSrc(incName)
-			if err != nil {
-				return nil, err
+		if directive, _ := splitSymbolDirective(srcLine); directive != "" {
+			resolvedLine = ""
+		} else if srcLine != "" {
+			resolvedLine = mapUnquoted(srcLine, func(s string) string {
+				return reSrcLabel.ReplaceAllStringFunc(s, func(s string) string {
+					if globalLabel, exists := externLabels[s]; exists {
+						return globalLabel
+					}
+
+					return s
+				})
+			})
+		}
+
+		resolvedSrcLines = append(resolvedSrcLines, resolvedLine)
+	}
+
+	asm.exports = globalLabels
+
+	return resolvedSrcLines, nil
+}
+
+// -----------------------------------------------------------------------------
+
+// splitEquDirective separates a value directive into its name and value, and
+// whether it is prefixed with the redefine token. Returns false if the line is
+// not a value directive.
+func splitEquDirective(srcLine string) (string, string, bool, bool) {
+	isRedefine := strings.HasPrefix(srcLine, redefineToken+" ")
+	if isRedefine {
+		srcLine = strings.TrimSpace(srcLine[len(redefineToken):])
+	}
+
+	fields := strings.Fields(srcLine)
+	if len(fields) < 2 || strings.ToUpper(fields[1]) != equToken {
+		return "", "", false, false
+	}
+
+	return fields[0], strings.Join(fields[2:], " "), isRedefine, true
+}
+
+// -----------------------------------------------------------------------------
+
+// formatEquDirective puts a value directive back together from its parts.
+func formatEquDirective(name string, value string, isRedefine bool) string {
+	equLine := name + " " + equToken + " " + value
+	if isRedefine {
+		equLine = redefineToken + " " + equLine
+	}
+
+	return equLine
+}
+
+// -----------------------------------------------------------------------------
+
+// resolveEquDirectives processes the value directives of all source and include
+// files. Every reference to a value name is replaced with its value, and the
+// directive lines are blanked out. Like preprocessor constants, a value name
+// can only be defined again with the redefine token, the last value applying
+// throughout.
+func (asm *assembly) resolveEquDirectives(srcLines []string, origins []srcOrigin) ([]string, error) {
+	equValues := make(map[string]string)
+
+	srcLabels := make(map[string]bool)
+	for _, srcLine := range srcLines {
+		if asm.isSrcLabel(srcLine) {
+			srcLabels[srcLine] = true
+		}
+	}
+
+	for lineNum, srcLine := range srcLines {
+		name, value, isRedefine, isEqu := splitEquDirective(srcLine)
+		if !isEqu {
+			continue
+		}
+
+		if !asm.isSrcLabel(name) {
+			return nil, newAssembleError(origins[lineNum], name, "Invalid "+equToken+" name "+name)
+		}
+
+		if srcLabels[name] {
+			return nil, newAssembleError(origins[lineNum], name, equToken+" name "+name+" is already a label")
+		}
+
+		if _, exists := equValues[name]; exists && !isRedefine {
+			return nil, newAssembleError(origins[lineNum], name, "Cannot redefine "+equToken+" value "+name+" without "+redefineToken)
+		}
+
+		if value == "" {
+			return nil, newAssembleError(origins[lineNum], srcLine, "Missing value for "+equToken+" name "+name)
+		}
+
+		if !is16BitHexString(value) {
+			return nil, newAssembleError(origins[lineNum], srcLine, "Invalid "+equToken+" value "+value+" for "+name+", expected a 16-bit hexadecimal value")
+		}
+
+		equValues[name] = strings.ToUpper(value)
+	}
+
+	var resolvedSrcLines []string
+
+	reSrcLabel := regexp.MustCompile(`(` + asm.getSrcLabelPattern() + `)`)
+
+	for _, srcLine := range srcLines {
+		resolvedLine := srcLine
+
+		if _, _, _, isEqu := splitEquDirective(srcLine); isEqu {
+			resolvedLine = ""
+		} else if srcLine != "" && len(equValues) > 0 {
+			mnemonic, rest := splitMnemonic(srcLine)
+
+			resolvedLine = mnemonic + mapUnquoted(rest, func(s string) string {
+				return reSrcLabel.ReplaceAllStringFunc(s, func(s string) string {
+					if value, exists := equValues[s]; exists {
+						return value
+					}
+
+					return s
+				})
+			})
+		}
+
+		resolvedSrcLines = append(resolvedSrcLines, resolvedLine)
+	}
+
+	return resolvedSrcLines, nil
+}
+
+// -----------------------------------------------------------------------------
+
+// mapUnquoted applies a function to every part of a line of source code that
+// is not enclosed in string or character quotes, leaving quoted text untouched.
+func mapUnquoted(srcLine string, f func(string) string) string {
+	var mappedLine string
+
+	quote := ""
+	start := 0
+
+	for i := 0; i < len(srcLine); i++ {
+		if quote != "" && strings.HasPrefix(srcLine[i:], escapeToken) {
+			i++
+		} else if quote != "" {
+			if strings.HasPrefix(srcLine[i:], quote) {
+				mappedLine += srcLine[start : i+1]
+				quote = ""
+				start = i + 1
 			}
-			printSrc("", rawIncLines)
+		} else if isQuoteToken(srcLine[i:]) {
+			quote = srcLine[i : i+1]
+			mappedLine += f(srcLine[start:i]) + quote
+			start = i + 1
+		}
+	}
 
-			rawIncLines = cleanSrc(rawIncLines)
-			printSrc("Removed comments and extraneous whitespace", rawIncLines)
+	if quote != "" {
+		return mappedLine + srcLine[start:]
+	}
 
-			rawIncLines, err = expandConsts(rawIncLines)
-			if err != nil {
-				return nil, err
+	return mappedLine + f(srcLine[start:])
+}
+
+// -----------------------------------------------------------------------------
+
+// findAllUnquoted returns all matches of a regular expression in a line of
+// source code outside of string and character quotes.
+func findAllUnquoted(re *regexp.Regexp, srcLine string) []string {
+	var found []string
+
+	mapUnquoted(srcLine, func(s string) string {
+		found = append(found, re.FindAllString(s, -1)...)
+
+		return s
+	})
+
+	return found
+}
+
+// -----------------------------------------------------------------------------
+
+// addIncludes reads rasm include files referenced in the source file,
+// processes them, recursively adds any include files they reference in turn and
+// returns the final, complete source code along with the origin of each line.
+// The include chain holds the names of the files currently being processed,
+// starting with the main source file. Include file names are resolved by
+// resolveIncName. A line starting with an escaped include
+// token is not an include directive; the escape is removed instead. Include
+// directives come in the legacy <name form and the #include "name" form, whose
+// quoted name may contain spaces.
+func (asm *assembly) addIncludes(srcLines []string, origins []srcOrigin, incChain []string) ([]string, []srcOrigin, error) {
+	var allSrcLines []string
+	var allOrigins []srcOrigin
+
+	for lineNum, srcLine := range srcLines {
+		if incRef, isInc := splitIncLine(srcLine); isInc {
+			if strings.HasPrefix(srcLine, quotedIncToken) && incRef != "" {
+				if !isDataString(incRef) {
+					return nil, nil, newAssembleError(origins[lineNum], incRef, "Include file name "+incRef+" must be quoted")
+				}
+
+				incRef = incRef[len(srcStringToken) : len(incRef)-len(srcStringToken)]
+			}
+
+			if incRef == "" {
+				return nil, nil, newAssembleError(origins[lineNum], srcLine, "Missing include file name")
+			}
+
+			incName := resolveIncName(incRef, incChain[len(incChain)-1], asm.opts.IncDirs)
+
+			for _, chainName := range incChain {
+				if chainName == incName {
+					return nil, nil, newAssembleError(origins[lineNum], incRef, "Circular include: "+strings.Join(append(incChain, incName), incChainDlm))
+				}
 			}
-			printSrc("Expanded preprocessor constants", rawIncLines)
 
-			if hasInclude(rawIncLines) {
-				return nil, errors.New("Inc file " + incName + " cannot contain includes of its own")
+			if len(incChain) > asm.opts.MaxIncDepth {
+				return nil, nil, newAssembleError(origins[lineNum], incRef, "Inc file "+incName+" exceeds maximum include depth of "+strconv.Itoa(asm.opts.MaxIncDepth)+": "+strings.Join(append(incChain, incName), incChainDlm))
 			}
 
-			rawIncLines = addSrcLabelNamespaces(rawIncLines, incName)
-			printSrc("Added label namespaces", rawIncLines)
+			asm.incNames = append(asm.incNames, incName)
+
+			rawIncLines, err := file.ReadSrc(incName)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			rawIncLines, incOrigins, err := asm.processIncSrc(rawIncLines, incName, incChain)
+			if err != nil {
+				return nil, nil, err
+			}
 
 			allSrcLines = append(allSrcLines, rawIncLines...)
+			allOrigins = append(allOrigins, incOrigins...)
+
+			if len(allSrcLines) > asm.opts.MaxExpandedLines {
+				return nil, nil, newAssembleError(origins[lineNum], incRef, "Inc file "+incName+" exceeds the expanded source limit of "+strconv.Itoa(asm.opts.MaxExpandedLines)+" lines")
+			}
 		} else {
+			if strings.HasPrefix(srcLine, escapeToken+incToken) {
+				srcLine = srcLine[len(escapeToken):]
+			}
+
 			allSrcLines = append(allSrcLines, srcLine)
+			allOrigins = append(allOrigins, origins[lineNum])
 		}
 	}
 
-	return allSrcLines, nil
+	return allSrcLines, allOrigins, nil
 }
 
 // -----------------------------------------------------------------------------
 
-// hasInclude checks whether an include file contains include files of its own.
-func hasInclude(srcLines []string) bool {
-	for _, srcLine := range srcLines {
-		if srcLine != "" && srcLine[:1] == incToken {
-			return true
+// splitIncLine separates the include file reference from a line of cleaned
+// source code, and whether the line is an include directive at all. The quotes
+// of a reference in the #include "name" form are kept.
+func splitIncLine(srcLine string) (string, bool) {
+	if firstChar(srcLine) == incToken {
+		return strings.TrimSpace(srcLine[len(incToken):]), true
+	}
+
+	if srcLine == quotedIncToken || strings.HasPrefix(srcLine, quotedIncToken+" ") {
+		return strings.TrimSpace(srcLine[len(quotedIncToken):]), true
+	}
+
+	return "", false
+}
+
+// -----------------------------------------------------------------------------
+
+// resolveIncName determines the path of an include file referenced in a source
+// or include file. Relative references are looked up in the including file's
+// directory first, then in the include directories in order and finally in the
+// working directory, as they were before. If the file is found nowhere, the
+// path relative to the including file is returned, so that reading it reports
+// the missing file.
+func resolveIncName(incRef string, includingName string, incDirs []string) string {
+	incName := filepath.Clean(incRef + file.IncExt)
+	if filepath.IsAbs(incName) {
+		return incName
+	}
+
+	localName := filepath.Join(filepath.Dir(includingName), incName)
+	if _, err := os.Stat(localName); err == nil {
+		return localName
+	}
+
+	for _, incDir := range incDirs {
+		dirName := filepath.Join(incDir, incName)
+		if _, err := os.Stat(dirName); err == nil {
+			return dirName
 		}
 	}
 
-	return false
+	if _, err := os.Stat(incName); err == nil {
+		return incName
+	}
+
+	return localName
 }
 
 // -----------------------------------------------------------------------------
 
-// hasDupeSrcLabels checks whether the source code contains duplicate labels.
-func hasDupeSrcLabels(srcLines []string) (bool, string, int) {
-	srcLabels := make(map[string]bool)
+// processIncSrc runs the source processing steps for the raw source code of an
+// include file, including its own include files. An include file that is empty
+// or contains only comments results in empty lines only.
+func (asm *assembly) processIncSrc(rawIncLines []string, incName string, incChain []string) ([]string, []srcOrigin, error) {
+	printSrc("", rawIncLines)
+
+	incOrigins := newSrcOrigins(incName, rawIncLines)
+
+	rawIncLines = asm.cleanSrc(rawIncLines)
+	printSrc("Removed comments and extraneous whitespace", rawIncLines)
+
+	rawIncLines, err := asm.joinContinuedLines(rawIncLines, incOrigins)
+	if err != nil {
+		return nil, nil, err
+	}
+	printSrc("Joined continued lines", rawIncLines)
+
+	rawIncLines, incOrigins = asm.splitInlineLabels(rawIncLines, incOrigins)
+	printSrc("Split inline labels", rawIncLines)
+
+	if asm.opts.NamespaceIncConsts {
+		rawIncLines = addConstNamespaces(rawIncLines, incName)
+		printSrc("Added preprocessor constant namespaces", rawIncLines)
+	}
+
+	rawIncLines, err = asm.expandConsts(rawIncLines, incOrigins, incName)
+	if err != nil {
+		return nil, nil, err
+	}
+	printSrc("Expanded preprocessor constants", rawIncLines)
+
+	rawIncLines = asm.addSrcLabelNamespaces(rawIncLines, incName)
+	printSrc("Added label namespaces", rawIncLines)
+
+	incIncChain := append([]string{}, incChain...)
+	incIncChain = append(incIncChain, incName)
+
+	return asm.addIncludes(rawIncLines, incOrigins, incIncChain)
+}
+
+// -----------------------------------------------------------------------------
+
+// applyPragmas processes the pragma directives of all source and include files
+// and blanks out their lines. An offset pragma sets the program offset, which
+// must agree with any explicitly given program offset and with other offset
+// pragmas, and must precede all other source code. Returns whether an offset
+// pragma was found.
+func applyPragmas(srcLines []string, origins []srcOrigin, programOffset uint16, explicitOffset bool) ([]string, uint16, bool, error) {
+	var appliedSrcLines []string
+
+	hasOffsetPragma := false
+	hasSrc := false
+
+	for lineNum, srcLine := range srcLines {
+		if !strings.HasPrefix(srcLine, pragmaToken+" ") {
+			appliedSrcLines = append(appliedSrcLines, srcLine)
+			hasSrc = hasSrc || srcLine != ""
+
+			continue
+		}
+
+		fields := strings.Fields(srcLine[len(pragmaToken):])
+		if len(fields) == 0 {
+			return nil, 0, false, newAssembleError(origins[lineNum], pragmaToken, "Missing pragma name")
+		}
+
+		switch strings.ToLower(fields[0]) {
+		case offsetPragma:
+			if len(fields) != 2 || !is16BitHexString(fields[1]) {
+				return nil, 0, false, newAssembleError(origins[lineNum], srcLine, "Invalid "+pragmaToken+" "+offsetPragma+", expected a 16-bit hexadecimal address")
+			}
+
+			if hasSrc {
+				return nil, 0, false, newAssembleError(origins[lineNum], pragmaToken, pragmaToken+" "+offsetPragma+" is only allowed at the start of the program")
+			}
+
+			offset, _ := strconv.ParseUint(fields[1], 16, 16)
+
+			if (explicitOffset || hasOffsetPragma) && uint16(offset) != programOffset {
+				return nil, 0, false, newAssembleError(origins[lineNum], fields[1], pragmaToken+" "+offsetPragma+" "+fields[1]+" disagrees with program offset "+strings.ToUpper(fmt.Sprintf("%04x", programOffset)))
+			}
+
+			programOffset = uint16(offset)
+			hasOffsetPragma = true
+		default:
+			return nil, 0, false, newAssembleError(origins[lineNum], fields[0], "Unknown pragma "+fields[0])
+		}
+
+		appliedSrcLines = append(appliedSrcLines, "")
+	}
+
+	return appliedSrcLines, programOffset, hasOffsetPragma, nil
+}
+
+// -----------------------------------------------------------------------------
+
+// getLabelOrigins finds all source labels and returns them along with the
+// origins of the lines they are defined on.
+func (asm *assembly) getLabelOrigins(srcLines []string, origins []srcOrigin) map[string]srcOrigin {
+	labelOrigins := make(map[string]srcOrigin)
+
+	for lineNum, srcLine := range srcLines {
+		if srcLine != "" && asm.isSrcLabel(srcLine) {
+			labelOrigins[srcLine] = origins[lineNum]
+		}
+	}
+
+	return labelOrigins
+}
+
+// -----------------------------------------------------------------------------
+
+// hasDupeSrcLabels checks whether the source code contains duplicate labels,
+// returning the first duplicate label along with the line numbers of its
+// duplicate and of its first definition.
+func (asm *assembly) hasDupeSrcLabels(srcLines []string) (bool, string, int, int) {
+	srcLabels := make(map[string]int)
 
 	for lineNum, srcLine := range srcLines {
-		if srcLine != "" && isSrcLabel(srcLine) {
-			if _, exists := srcLabels[srcLine]; exists {
-				return true, srcLine, lineNum
+		if srcLine != "" && asm.isSrcLabel(srcLine) {
+			if firstLineNum, exists := srcLabels[srcLine]; exists {
+				return true, srcLine, lineNum, firstLineNum
 			}
 
-			srcLabels[srcLine] = true
+			srcLabels[srcLine] = lineNum
 		}
 	}
 
-	return false, "", 0
+	return false, "", 0, 0
 }
 
 // -----------------------------------------------------------------------------
 
-// printSrc prints unstructured source code for debugging purposes.
+// printSrc prints unstructured source code to standard error for debugging
+// purposes.
 func printSrc(message string, srcLines []string) {
 	if DEBUG {
-		fmt.Println(message)
+		fmt.Fprintln(os.Stderr, message)
 
 		for lineNum, srcLine := range srcLines {
-			fmt.Print(lineNum + 1)
-			fmt.Println("\t" + srcLine)
+			fmt.Fprint(os.Stderr, lineNum+1)
+			fmt.Fprintln(os.Stderr, "\t"+srcLine)
 		}
 	}
 }
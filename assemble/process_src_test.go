@@ -0,0 +1,162 @@
+/*
+Copyright 2018-2019 Juan Irming
+
+This file is part of rasm16.
+
+rasm16 is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+rasm16 is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with rasm16.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package assemble
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// -----------------------------------------------------------------------------
+
+// TestIncludePaths assembles a source file with include files found next to
+// the including include file, in an include directory and in the working
+// directory, i.e. the package directory.
+func TestIncludePaths(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "rasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	incFiles := map[string]string{
+		"sub/lib/first._rasm":  "<second\n    $8   01\n",
+		"sub/lib/second._rasm": "    $8   02\n",
+		"incdir/third._rasm":   "    $8   03\n",
+	}
+
+	for incName, incSrc := range incFiles {
+		incPath := filepath.Join(tmpDir, filepath.FromSlash(incName))
+
+		err = os.MkdirAll(filepath.Dir(incPath), 0777)
+		if err == nil {
+			err = ioutil.WriteFile(incPath, []byte(incSrc), 0666)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	src := []string{
+		"<lib/first",
+		"<third",
+		"<testdata/cwd_lib",
+	}
+
+	opts := DefaultOptions()
+	opts.IncDirs = []string{filepath.Join(tmpDir, "incdir")}
+
+	program := testProgram{
+		srcName: filepath.Join(tmpDir, "sub", "main.rasm"),
+		offset:  0x1000,
+		src:     src,
+		bin:     []byte{0x02, 0x01, 0x03, 0x04},
+	}
+
+	bin, asm, err := assembleTest(program.src, program.srcName, program.offset, opts)
+	if err == nil {
+		err = checkTestProgram(program, bin, asm.warnings)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = assembleTest(src[1:2], program.srcName, program.offset, DefaultOptions())
+	if err == nil {
+		t.Error("Found include file outside of the include directories")
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// TestIncDepth assembles a source file with include files nested as deep as the
+// maximum include depth allows, then fails with a maximum one level lower.
+func TestIncDepth(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "rasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	incFiles := map[string]string{
+		"first._rasm":  "<second\n",
+		"second._rasm": "<third\n",
+		"third._rasm":  "    $8   03\n",
+	}
+
+	for incName, incSrc := range incFiles {
+		err = ioutil.WriteFile(filepath.Join(tmpDir, incName), []byte(incSrc), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	program := testProgram{
+		srcName: filepath.Join(tmpDir, "main.rasm"),
+		offset:  0x1000,
+		src:     []string{"<first"},
+		bin:     []byte{0x03},
+	}
+
+	opts := DefaultOptions()
+	opts.MaxIncDepth = 3
+
+	bin, asm, err := assembleTest(program.src, program.srcName, program.offset, opts)
+	if err == nil {
+		err = checkTestProgram(program, bin, asm.warnings)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts.MaxIncDepth = 2
+
+	_, _, err = assembleTest(program.src, program.srcName, program.offset, opts)
+	if assembleErr, ok := err.(AssembleError); !ok || !strings.Contains(assembleErr.Message, "exceeds maximum include depth of 2") {
+		t.Errorf("Expected maximum include depth error, got %v", err)
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// TestEvalConstExpr evaluates purely numeric preprocessor constant values and
+// verifies that any other value is returned unchanged.
+func TestEvalConstExpr(t *testing.T) {
+	values := map[string]string{
+		"1000 + 10*2 - 8/4":     "101E",
+		"FFFE+1":                "FFFF",
+		"1000":                  "1000",
+		"table_end-table_start": "table_end-table_start",
+		"table_end-2":           "table_end-2",
+		"12 34-5":               "12 34-5",
+		"$1000+2":               "$1000+2",
+		"-1":                    "-1",
+	}
+
+	for value, expected := range values {
+		result, err := evalConstExpr(value)
+		if err != nil || result != expected {
+			t.Errorf("Value %s mismatch, expected \"%s\", got \"%s\" (%v)", value, expected, result, err)
+		}
+	}
+}
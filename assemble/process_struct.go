@@ -22,61 +22,198 @@ package assemble
 import (
 	"errors"
 	"fmt"
+	"os"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 )
 
 // -----------------------------------------------------------------------------
 
-// Maximum address space limit.
-const maxAddressSpace int = 0xFFB0 - 2*128 // Leaving space for call stack below Stack Pointer.
+// Bank directive token definition, switching subsequent code and data to
+// another bank with its own program counter.
+const bankToken string = "BANK"
+
+// Align directive token definition, padding with zeros up to the next address
+// that is a multiple of its operand, a hexadecimal or decimal power of two.
+// Labels of the directive resolve to the padded address.
+const alignToken string = "ALIGN"
+
+// Note directive token definition, carrying a string that shows up in the
+// listing at its position without emitting anything.
+const noteToken string = "NOTE"
+
+// Origin directive token definition, setting the program offset when used at
+// the start of the program.
+const orgToken string = "ORG"
+
+// Built-in symbol usable as a 16-bit data value, resolving to the program size
+// in bytes, i.e. all code and data excluding header, padding and footer.
+const sizeSymbol string = "__SIZE__"
+
+// Whether the program offset was given explicitly, in which case a leading
+// origin directive has to agree with it.
+var ExplicitOffset bool = false
 
 // Parser token definitions.
 const (
 	srcStringToken       string = `"`
+	srcCharToken         string = "'"
 	nullRepeatStartToken string = "("
 	nullRepeatEndToken   string = ")"
+	labelDiffToken       string = "-"
+	decimalToken         string = "#"
+)
+
+// Default data directive value delimiter, also used by self-test programs.
+const defaultDataDlm string = ","
+
+// Data directive value delimiter.
+var DataDlm string = defaultDataDlm
+
+// Data string escape sequence token definitions.
+const (
+	escapeToken    string = `\`
+	hexEscapeToken string = "x"
 )
 
-// Data directive value delimiter definition.
-const dataDlm string = ","
+// Named data string escape sequences and the byte values they represent.
+var namedEscapes = map[string]byte{
+	"0": 0x00,
+	"t": 0x09,
+	"n": 0x0A,
+	"r": 0x0D,
+}
+
+// Data string element definition, either a character or a raw byte value
+// produced by an escape sequence.
+type stringElem struct {
+	char  rune
+	raw   bool
+	value byte
+}
 
 type directiveType int
 
 // Data directive type definitions.
 const (
-	invalidDirective   directiveType = 0
-	data8BitDirective  directiveType = 1
-	data16BitDirective directiveType = 2
+	invalidDirective         directiveType = 0
+	data8BitDirective        directiveType = 1
+	data16BitDirective       directiveType = 2
+	data8BitCharsetDirective directiveType = 3
 )
 
 // Data directive token definitions.
 var directiveTokens = map[directiveType]string{
-	data8BitDirective:  "$8",
-	data16BitDirective: "$16",
+	data8BitDirective:        "$8",
+	data16BitDirective:       "$16",
+	data8BitCharsetDirective: "$8C",
 }
 
 type opType int
 
 // Operand type definitions.
 const (
-	invalidOp opType = 0
-	addressOp opType = 1
-	literalOp opType = 2
-	pointerOp opType = 3
+	invalidOp  opType = 0
+	addressOp  opType = 1
+	literalOp  opType = 2
+	pointerOp  opType = 3
+	relativeOp opType = 4
 )
 
 // Parser operand token definitions.
 var opTokens = map[opType]string{
-	literalOp: "$",
-	pointerOp: "*",
+	literalOp:  "$",
+	pointerOp:  "*",
+	relativeOp: "~",
 }
 
 // Human-readable operand descriptions.
 var opDescr = map[opType]string{
-	literalOp: "LITERAL",
-	pointerOp: "POINTER",
+	literalOp:  "LITERAL",
+	pointerOp:  "POINTER",
+	relativeOp: "RELATIVE",
+}
+
+// Jump family mnemonics, whose operand is a target address.
+var jumpMnemonics = map[string]bool{
+	"EQ": true,
+	"NE": true,
+	"LT": true,
+	"GT": true,
+	"EL": true,
+	"EG": true,
+	"JM": true,
+	"JS": true,
+	"RT": true,
+}
+
+// Division family mnemonics, whose source operand is the divisor.
+var divisionMnemonics = map[string]bool{
+	"DV8":  true,
+	"DV16": true,
+}
+
+// Whether to warn about jump targets outside of the program.
+var CheckJumpTargets bool = false
+
+// Whether to warn about labels sharing an address.
+var WarnSharedLabels bool = false
+
+// Operand type set definition.
+type opTypes map[opType]bool
+
+// Operand type sets shared by several mnemonics. Single operands are always
+// encoded the same way, so pointers are only allowed with two operands.
+var (
+	sourceOpTypes  = opTypes{literalOp: true, addressOp: true, pointerOp: true}
+	targetOpTypes  = opTypes{addressOp: true, pointerOp: true}
+	jumpOpTypes    = opTypes{literalOp: true, addressOp: true, relativeOp: true}
+	valueOpTypes   = opTypes{literalOp: true, addressOp: true}
+	bankNumOpTypes = opTypes{addressOp: true}
+	alignOpTypes   = opTypes{addressOp: true}
+)
+
+// Allowed operand types for each operand of each mnemonic with operands.
+var mnemonicOpTypes = map[string][]opTypes{
+	// Instructions
+	"CO8":  {sourceOpTypes, targetOpTypes},
+	"CO16": {sourceOpTypes, targetOpTypes},
+	"AD8":  {sourceOpTypes, targetOpTypes},
+	"AD16": {sourceOpTypes, targetOpTypes},
+	"SU8":  {sourceOpTypes, targetOpTypes},
+	"SU16": {sourceOpTypes, targetOpTypes},
+	"MU8":  {sourceOpTypes, targetOpTypes},
+	"MU16": {sourceOpTypes, targetOpTypes},
+	"DV8":  {sourceOpTypes, targetOpTypes},
+	"DV16": {sourceOpTypes, targetOpTypes},
+	"ND8":  {sourceOpTypes, targetOpTypes},
+	"ND16": {sourceOpTypes, targetOpTypes},
+	"OR8":  {sourceOpTypes, targetOpTypes},
+	"OR16": {sourceOpTypes, targetOpTypes},
+	"XR8":  {sourceOpTypes, targetOpTypes},
+	"XR16": {sourceOpTypes, targetOpTypes},
+	"SL8":  {sourceOpTypes, targetOpTypes},
+	"SL16": {sourceOpTypes, targetOpTypes},
+	"SR8":  {sourceOpTypes, targetOpTypes},
+	"SR16": {sourceOpTypes, targetOpTypes},
+	"CM8":  {sourceOpTypes, targetOpTypes},
+	"CM16": {sourceOpTypes, targetOpTypes},
+	"EQ":   {jumpOpTypes},
+	"NE":   {jumpOpTypes},
+	"LT":   {jumpOpTypes},
+	"GT":   {jumpOpTypes},
+	"EL":   {jumpOpTypes},
+	"EG":   {jumpOpTypes},
+	"JM":   {jumpOpTypes},
+	"JS":   {jumpOpTypes},
+	"RT":   {valueOpTypes},
+
+	// Directives
+	"BANK":  {bankNumOpTypes},
+	"ALIGN": {alignOpTypes},
 }
 
 // Human-readable operand description.
@@ -98,7 +235,9 @@ var mnemonicAliases = map[string]string{
 	"CM": "CM16",
 
 	// Directives
-	"$": "$16",
+	"$":      "$16",
+	".ALIGN": "ALIGN",
+	".NOTE":  "NOTE",
 }
 
 // Mnemonic type definition.
@@ -109,7 +248,9 @@ type mnemonic struct {
 	instrLength int
 }
 
-// Mnemonic definitions (instructions and directives).
+// Mnemonic definitions (instructions and directives). Instruction opcodes take
+// five bits, all of which are in use, so another instruction needs a change of
+// the instruction set rather than just a fresh opcode.
 var mnemonics = map[string]mnemonic{
 	// Instructions
 	"NO":   {descr: "NO OPERATION", opcode: 0x00, numOps: 0, instrLength: 1},
@@ -132,7 +273,7 @@ var mnemonics = map[string]mnemonic{
 	"SL8":  {descr: "BITWISE SHIFT LEFT", opcode: 0x11, numOps: 2, instrLength: 5},
 	"SL16": {descr: "BITWISE SHIFT LEFT", opcode: 0x12, numOps: 2, instrLength: 5},
 	"SR8":  {descr: "BITWISE SHIFT RIGHT", opcode: 0x13, numOps: 2, instrLength: 5},
-	"SR16": {descr: "BITWISE SHIFT RIGHT", opcode: 0x15, numOps: 2, instrLength: 5},
+	"SR16": {descr: "BITWISE SHIFT RIGHT", opcode: 0x14, numOps: 2, instrLength: 5},
 	"CM8":  {descr: "COMPARE", opcode: 0x15, numOps: 2, instrLength: 5},
 	"CM16": {descr: "COMPARE", opcode: 0x16, numOps: 2, instrLength: 5},
 	"EQ":   {descr: "JUMP IF EQUAL", opcode: 0x17, numOps: 1, instrLength: 3},
@@ -146,8 +287,129 @@ var mnemonics = map[string]mnemonic{
 	"RT":   {descr: "RETURN", opcode: 0x1F, numOps: 1, instrLength: 3},
 
 	// Directives
-	"$8":  {descr: "DATA DIRECTIVE", opcode: 0x00, numOps: 0, instrLength: 0},
-	"$16": {descr: "DATA DIRECTIVE", opcode: 0x00, numOps: 0, instrLength: 0},
+	"$8":    {descr: "DATA DIRECTIVE", opcode: 0x00, numOps: 0, instrLength: 0},
+	"$16":   {descr: "DATA DIRECTIVE", opcode: 0x00, numOps: 0, instrLength: 0},
+	"$8C":   {descr: "CHARSET DATA DIRECTIVE", opcode: 0x00, numOps: 0, instrLength: 0},
+	"BANK":  {descr: "BANK DIRECTIVE", opcode: 0x00, numOps: 1, instrLength: 0},
+	"ALIGN": {descr: "ALIGN DIRECTIVE", opcode: 0x00, numOps: 1, instrLength: 0},
+	"NOTE":  {descr: "NOTE DIRECTIVE", opcode: 0x00, numOps: 0, instrLength: 0},
+}
+
+// Nominal cycle counts per mnemonic, used for timing estimates only.
+var mnemonicCycles = map[string]int{
+	// Instructions
+	"NO":   1,
+	"CO8":  4,
+	"CO16": 5,
+	"AD8":  4,
+	"AD16": 5,
+	"SU8":  4,
+	"SU16": 5,
+	"MU8":  8,
+	"MU16": 12,
+	"DV8":  16,
+	"DV16": 24,
+	"ND8":  4,
+	"ND16": 5,
+	"OR8":  4,
+	"OR16": 5,
+	"XR8":  4,
+	"XR16": 5,
+	"SL8":  4,
+	"SL16": 5,
+	"SR8":  4,
+	"SR16": 5,
+	"CM8":  4,
+	"CM16": 5,
+	"EQ":   3,
+	"NE":   3,
+	"LT":   3,
+	"GT":   3,
+	"EL":   3,
+	"EG":   3,
+	"JM":   3,
+	"JS":   6,
+	"RT":   6,
+
+	// Directives
+	"$8":    0,
+	"$16":   0,
+	"$8C":   0,
+	"BANK":  0,
+	"ALIGN": 0,
+	"NOTE":  0,
+}
+
+// -----------------------------------------------------------------------------
+
+// PrintMnemonics outputs a table of all supported instructions and directives
+// along with their opcodes, number of operands and lengths, followed by all
+// mnemonic aliases.
+func PrintMnemonics() {
+	var names []string
+
+	for name := range mnemonics {
+		names = append(names, name)
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		iMnemonic, jMnemonic := mnemonics[names[i]], mnemonics[names[j]]
+
+		if (iMnemonic.instrLength == 0) != (jMnemonic.instrLength == 0) {
+			return iMnemonic.instrLength != 0
+		}
+
+		if iMnemonic.opcode != jMnemonic.opcode {
+			return iMnemonic.opcode < jMnemonic.opcode
+		}
+
+		return names[i] < names[j]
+	})
+
+	fmt.Println("MNEMONIC\tOPCODE\tOPERANDS\tLENGTH\tDESCRIPTION")
+
+	for _, name := range names {
+		opcode := "-"
+		if mnemonics[name].instrLength != 0 {
+			opcode = strings.ToUpper(fmt.Sprintf("%02x", mnemonics[name].opcode))
+		}
+
+		fmt.Println(name + "\t\t" + opcode + "\t" + strconv.Itoa(mnemonics[name].numOps) + "\t\t" + strconv.Itoa(mnemonics[name].instrLength) + "\t" + mnemonics[name].descr)
+	}
+
+	var aliases []string
+
+	for alias := range mnemonicAliases {
+		aliases = append(aliases, alias)
+	}
+
+	sort.Strings(aliases)
+
+	fmt.Println()
+	fmt.Println("ALIAS\t\tMNEMONIC")
+
+	for _, alias := range aliases {
+		fmt.Println(alias + "\t\t" + mnemonicAliases[alias])
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// Cycles returns the nominal cycle count of an instruction or directive, given
+// its mnemonic or a mnemonic alias. Directives take zero cycles.
+func Cycles(name string) (int, error) {
+	name = strings.ToUpper(name)
+
+	if _, exists := mnemonicAliases[name]; exists {
+		name = mnemonicAliases[name]
+	}
+
+	cycles, exists := mnemonicCycles[name]
+	if !exists {
+		return 0, errors.New("Invalid mnemonic " + name)
+	}
+
+	return cycles, nil
 }
 
 // -----------------------------------------------------------------------------
@@ -172,25 +434,111 @@ func unaliasMnemonics(srcLines []srcLine) []srcLine {
 
 // -----------------------------------------------------------------------------
 
+// applyLeadingOrg removes an origin directive from the start of the program and
+// returns its address as the new program offset, which must agree with an
+// explicitly given program offset. Any label of the directive is moved to the
+// following line.
+func applyLeadingOrg(srcLines []srcLine, programOffset uint16, explicitOffset bool) ([]srcLine, uint16, error) {
+	for lineNum, srcLine := range srcLines {
+		if srcLine.mnemonic != orgToken {
+			continue
+		}
+
+		if lineNum > 0 {
+			return nil, 0, newAssembleError(srcLine.srcOrigin, srcLine.mnemonic, orgToken+" is only allowed at the start of the program")
+		}
+
+		if srcLine.op1Type != addressOp || !is16BitHexString(srcLine.op1) || srcLine.op2 != "" || srcLine.unexpected != "" {
+			return nil, 0, newAssembleError(srcLine.srcOrigin, srcLine.op1, "Invalid "+orgToken+" address "+srcLine.op1)
+		}
+
+		org, _ := strconv.ParseUint(srcLine.op1, 16, 16)
+
+		if explicitOffset && uint16(org) != programOffset {
+			return nil, 0, newAssembleError(srcLine.srcOrigin, srcLine.op1, orgToken+" "+srcLine.op1+" disagrees with program offset "+strings.ToUpper(fmt.Sprintf("%04x", programOffset)))
+		}
+
+		programOffset = uint16(org)
+	}
+
+	if len(srcLines) > 0 && srcLines[0].mnemonic == orgToken {
+		if len(srcLines) > 1 && srcLines[1].label == "" {
+			srcLines[1].label = srcLines[0].label
+			srcLines[1].stackedLabels = srcLines[0].stackedLabels
+		} else if len(srcLines) > 1 {
+			srcLines[1].stackedLabels = append(getLineLabels(srcLines[0]), srcLines[1].stackedLabels...)
+		}
+
+		srcLines = srcLines[1:]
+	}
+
+	return srcLines, programOffset, nil
+}
+
+// -----------------------------------------------------------------------------
+
+// validateDataDlm checks whether a data directive value delimiter can be told
+// apart from data values, from the comment character, from the instruction
+// delimiter and from other source code syntax.
+func validateDataDlm(dlm string, commentChar string, instrDlm string) error {
+	if dlm == "" {
+		return errors.New("Data delimiter cannot be empty")
+	}
+
+	reReserved := regexp.MustCompile(`[\w\s.()\-\[\]"'\\]`)
+
+	if reReserved.MatchString(dlm) || strings.Contains(dlm, commentChar) || strings.Contains(dlm, instrDlm) || strings.Contains(instrDlm, dlm) {
+		return errors.New("Data delimiter " + dlm + " clashes with source code syntax")
+	}
+
+	return nil
+}
+
+// -----------------------------------------------------------------------------
+
+// splitDataValues splits data directive values around each data delimiter that
+// is not enclosed in string or character quotes. Whitespace around the values
+// is removed.
+func (asm *assembly) splitDataValues(data string) []string {
+	splitData := splitUnquoted(data, asm.opts.DataDlm)
+
+	for i, value := range splitData {
+		splitData[i] = strings.TrimSpace(value)
+	}
+
+	return splitData
+}
+
+// -----------------------------------------------------------------------------
+
 // expandDataNullRepeats translates data directive null repeat syntax to full
-// data directive value lists.
-func expandDataNullRepeats(srcLines []srcLine) ([]srcLine, error) {
+// data directive value lists, repeating a null value of the directive's width.
+// Repeated null values count towards the expanded source limit.
+func (asm *assembly) expandDataNullRepeats(srcLines []srcLine) ([]srcLine, error) {
 	var expandedSrcLines []srcLine
 
+	numExpandedLines := len(srcLines)
+
 	for _, srcLine := range srcLines {
 		currentSrcLine := srcLine
 
 		if isValidDataDirective(srcLine.mnemonic) && isDataNullRepeat(srcLine.data) {
 			num_repeats, err := strconv.Atoi(srcLine.data[1 : len(srcLine.data)-1])
-			if err != nil {
-				return nil, errors.New(strconv.Itoa(srcLine.lineNum+1) + ":\tInvalid data null repeat " + srcLine.data)
+			if err != nil || num_repeats < 1 {
+				return nil, newAssembleError(srcLine.srcOrigin, srcLine.data, "Invalid data null repeat "+srcLine.data)
+			}
+
+			numExpandedLines += num_repeats - 1
+			if numExpandedLines > asm.opts.MaxExpandedLines {
+				return nil, newAssembleError(srcLine.srcOrigin, srcLine.data, "Data null repeat "+srcLine.data+" exceeds the expanded source limit of "+strconv.Itoa(asm.opts.MaxExpandedLines)+" lines")
 			}
 
-			currentSrcLine.data = ""
-			for i := 1; i < num_repeats; i++ {
-				currentSrcLine.data += defaultConsts["[NULL]"] + dataDlm
+			null := magicValueConsts["[NULL]"]
+			if srcLine.mnemonic == directiveTokens[data8BitDirective] {
+				null = null[len(null)-2:]
 			}
-			currentSrcLine.data += defaultConsts["[NULL]"]
+
+			currentSrcLine.data = strings.Repeat(null+asm.opts.DataDlm, num_repeats-1) + null
 		}
 
 		expandedSrcLines = append(expandedSrcLines, currentSrcLine)
@@ -203,53 +551,295 @@ func expandDataNullRepeats(srcLines []srcLine) ([]srcLine, error) {
 
 // isDataNullRepeat checks whether a data directive contains null repeat syntax.
 func isDataNullRepeat(data string) bool {
-	return len(data) > 0 &&
-		data[:1] == nullRepeatStartToken &&
+	return firstChar(data) == nullRepeatStartToken &&
 		data[len(data)-1:] == nullRepeatEndToken
 }
 
 // -----------------------------------------------------------------------------
 
-// convDataStringsToHex converts data directive strings to value lists.
-func convDataStringsToHex(srcLines []srcLine) []srcLine {
+// convDataStringsToHex converts data directive strings to value lists. Strings
+// can be mixed with other values, e.g. "Hi",00, each string being converted in
+// place. Charset data directive strings are mapped through the active charset
+// table and turn into plain 8-bit data directives.
+func (asm *assembly) convDataStringsToHex(srcLines []srcLine) ([]srcLine, error) {
+	var convSrcLines []srcLine
+
+	for _, srcLine := range srcLines {
+		currentSrcLine := srcLine
+
+		if srcLine.mnemonic == directiveTokens[data8BitDirective] || srcLine.mnemonic == directiveTokens[data8BitCharsetDirective] {
+			hexData, hasString, err := asm.dataStringsToHex(srcLine)
+			if err != nil {
+				return nil, err
+			}
+
+			if srcLine.mnemonic == directiveTokens[data8BitCharsetDirective] {
+				if !hasString {
+					return nil, newAssembleError(srcLine.srcOrigin, srcLine.mnemonic, srcLine.mnemonic+" needs a string")
+				}
+
+				currentSrcLine.mnemonic = directiveTokens[data8BitDirective]
+			}
+
+			if hasString {
+				currentSrcLine.data = hexData
+			}
+		} else if isSrcDataLine(srcLine.mnemonic) && isUnterminatedDataString(srcLine.data) {
+			return nil, newAssembleError(srcLine.srcOrigin, srcLine.data, "Unterminated string "+srcLine.data)
+		}
+
+		convSrcLines = append(convSrcLines, currentSrcLine)
+	}
+
+	return convSrcLines, nil
+}
+
+// -----------------------------------------------------------------------------
+
+// dataStringsToHex converts every string among the values of an 8-bit data
+// directive to a value list, charset strings using the active charset table,
+// and returns the resulting values along with whether there was any string.
+func (asm *assembly) dataStringsToHex(srcLine srcLine) (string, bool, error) {
+	var values []string
+
+	hasString := false
+
+	for _, data := range asm.splitDataValues(srcLine.data) {
+		if isUnterminatedDataString(data) {
+			return "", false, newAssembleError(srcLine.srcOrigin, data, "Unterminated string "+data)
+		}
+
+		if !isDataString(data) {
+			values = append(values, data)
+
+			continue
+		}
+
+		hasString = true
+
+		stringSrcLine := srcLine
+		stringSrcLine.data = data
+
+		var hexData string
+		var err error
+
+		if srcLine.mnemonic == directiveTokens[data8BitCharsetDirective] {
+			hexData, err = asm.charsetStringToHex(stringSrcLine)
+		} else {
+			hexData, err = asm.dataStringToHex(stringSrcLine)
+		}
+		if err != nil {
+			return "", false, err
+		}
+
+		if hexData != "" {
+			values = append(values, hexData)
+		}
+	}
+
+	return strings.Join(values, asm.opts.DataDlm), hasString, nil
+}
+
+// -----------------------------------------------------------------------------
+
+// convDataDecimalsToHex converts signed decimal data directive values, e.g.
+// #-1 or #1000, to hexadecimal values of the directive's width, using two's
+// complement for negative values. Decimal values need a comment character other
+// than the decimal token, which otherwise starts a comment as usual.
+func (asm *assembly) convDataDecimalsToHex(srcLines []srcLine) ([]srcLine, error) {
 	var convSrcLines []srcLine
 
 	for _, srcLine := range srcLines {
 		currentSrcLine := srcLine
 
-		if srcLine.mnemonic == directiveTokens[data8BitDirective] && isDataString(srcLine.data) {
-			currentSrcLine.data = dataStringToHex(srcLine.data)
+		if isValidDataDirective(srcLine.mnemonic) && strings.Contains(srcLine.data, decimalToken) {
+			splitData := asm.splitDataValues(srcLine.data)
+
+			for i, data := range splitData {
+				if !strings.HasPrefix(data, decimalToken) {
+					continue
+				}
+
+				hexData, err := decimalToHex(srcLine, data)
+				if err != nil {
+					return nil, err
+				}
+
+				splitData[i] = hexData
+			}
+
+			currentSrcLine.data = strings.Join(splitData, asm.opts.DataDlm)
 		}
 
 		convSrcLines = append(convSrcLines, currentSrcLine)
 	}
 
-	return convSrcLines
+	return convSrcLines, nil
+}
+
+// -----------------------------------------------------------------------------
+
+// decimalToHex converts a signed decimal data value to a hexadecimal value of
+// the width of the line's data directive.
+func decimalToHex(srcLine srcLine, data string) (string, error) {
+	bits, digits := 16, 4
+	if srcLine.mnemonic == directiveTokens[data8BitDirective] {
+		bits, digits = 8, 2
+	}
+
+	value, err := strconv.ParseInt(data[len(decimalToken):], 10, 32)
+	if err != nil {
+		return "", newAssembleError(srcLine.srcOrigin, data, "Invalid decimal value "+data)
+	}
+
+	if value < -(1<<uint(bits-1)) || value >= 1<<uint(bits) {
+		return "", newAssembleError(srcLine.srcOrigin, data, "Decimal value "+data+" does not fit in "+srcLine.mnemonic)
+	}
+
+	return strings.ToUpper(fmt.Sprintf("%0*x", digits, value&(1<<uint(bits)-1))), nil
 }
 
 // -----------------------------------------------------------------------------
 
 // isDataString checks whether a data directive contains a string.
 func isDataString(data string) bool {
-	return len(data) > 0 &&
-		data[:1] == srcStringToken &&
+	return len(data) > 1 &&
+		firstChar(data) == srcStringToken &&
 		data[len(data)-1:] == srcStringToken
 }
 
 // -----------------------------------------------------------------------------
 
-// dataStringToHex converts a single data directive string to a value list.
-func dataStringToHex(dataString string) string {
-	bytes := []byte(dataString)
+// isUnterminatedDataString checks whether a data directive opens a string
+// without closing it, taking escaped quotes into account.
+func isUnterminatedDataString(data string) bool {
+	if !strings.HasPrefix(data, srcStringToken) {
+		return false
+	}
+
+	for i := 1; i < len(data); i++ {
+		if strings.HasPrefix(data[i:], escapeToken) {
+			i++
+		} else if strings.HasPrefix(data[i:], srcStringToken) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// -----------------------------------------------------------------------------
+
+// dataStringToHex converts a single data directive string, including its
+// surrounding quote characters, to a value list.
+func (asm *assembly) dataStringToHex(srcLine srcLine) (string, error) {
+	elems, err := parseDataString(srcLine)
+	if err != nil {
+		return "", err
+	}
+
+	bytes := []byte(srcStringToken)
+	for _, elem := range elems {
+		if elem.raw {
+			bytes = append(bytes, elem.value)
+		} else {
+			bytes = append(bytes, string(elem.char)...)
+		}
+	}
+	bytes = append(bytes, srcStringToken...)
 
 	var hex []string
 	for _, byte := range bytes {
 		hex = append(hex, strings.ToUpper(fmt.Sprintf("%x", byte)))
 	}
 
-	hexData := strings.Join(hex, dataDlm)
+	hexData := strings.Join(hex, asm.opts.DataDlm)
+
+	return hexData, nil
+}
+
+// -----------------------------------------------------------------------------
+
+// parseDataString breaks down a data directive string into characters and raw
+// byte values, resolving escape sequences such as \n, \" and \xNN.
+func parseDataString(srcLine srcLine) ([]stringElem, error) {
+	var elems []stringElem
+
+	dataString := srcLine.data[1 : len(srcLine.data)-1]
+
+	for i := 0; i < len(dataString); {
+		char, size := utf8.DecodeRuneInString(dataString[i:])
+
+		if string(char) != escapeToken {
+			elems = append(elems, stringElem{char: char})
+			i += size
+
+			continue
+		}
+
+		escape := dataString[i+1:]
+
+		switch {
+		case escape == "":
+			return nil, newAssembleError(srcLine.srcOrigin, escapeToken, "Incomplete escape sequence "+escapeToken)
+		case firstChar(escape) == escapeToken || firstChar(escape) == srcStringToken:
+			elems = append(elems, stringElem{char: rune(escape[0])})
+			i += 2
+		case firstChar(escape) == hexEscapeToken:
+			if len(escape) < 3 || !is8BitHexString(escape[1:3]) {
+				invalidEscape := escapeToken + escape
+				if len(escape) > 3 {
+					invalidEscape = escapeToken + escape[:3]
+				}
+
+				return nil, newAssembleError(srcLine.srcOrigin, invalidEscape, "Invalid hex escape sequence "+invalidEscape)
+			}
+
+			value, _ := strconv.ParseUint(escape[1:3], 16, 8)
+			elems = append(elems, stringElem{raw: true, value: byte(value)})
+			i += 4
+		default:
+			value, exists := namedEscapes[firstChar(escape)]
+			if !exists {
+				return nil, newAssembleError(srcLine.srcOrigin, escapeToken+firstChar(escape), "Invalid escape sequence "+escapeToken+firstChar(escape))
+			}
+
+			elems = append(elems, stringElem{raw: true, value: value})
+			i += 2
+		}
+	}
+
+	return elems, nil
+}
+
+// -----------------------------------------------------------------------------
+
+// charsetStringToHex converts a charset data directive string to a value list
+// using the active charset table.
+func (asm *assembly) charsetStringToHex(srcLine srcLine) (string, error) {
+	var hex []string
+
+	elems, err := parseDataString(srcLine)
+	if err != nil {
+		return "", err
+	}
+
+	for _, elem := range elems {
+		value := elem.value
+
+		if !elem.raw {
+			var exists bool
+
+			value, exists = asm.opts.Charset[elem.char]
+			if !exists {
+				return "", newAssembleError(srcLine.srcOrigin, string(elem.char), "Character "+string(elem.char)+" not in charset")
+			}
+		}
+
+		hex = append(hex, strings.ToUpper(fmt.Sprintf("%x", value)))
+	}
 
-	return hexData
+	return strings.Join(hex, asm.opts.DataDlm), nil
 }
 
 // -----------------------------------------------------------------------------
@@ -257,8 +847,18 @@ func dataStringToHex(dataString string) string {
 // validateMnemonics checks whether any invalid mnemonics exist.
 func validateMnemonics(srcLines []srcLine) (bool, error) {
 	for _, srcLine := range srcLines {
+		if srcLine.mnemonic == endOfSrcMnemonic {
+			continue
+		}
+
 		if _, exists := mnemonics[srcLine.mnemonic]; !exists {
-			return false, errors.New(strconv.Itoa(srcLine.lineNum+1) + ":\tInvalid mnemonic " + srcLine.mnemonic)
+			if firstChar(srcLine.mnemonic) == dataLineToken {
+				token := rawToken(srcLine.rawLine, srcLine.mnemonic)
+
+				return false, newAssembleError(srcLine.srcOrigin, token, "Ambiguous token "+token+", data directives are "+getDataDirectiveNames())
+			}
+
+			return false, newAssembleError(srcLine.srcOrigin, srcLine.mnemonic, "Invalid mnemonic "+srcLine.mnemonic)
 		}
 	}
 
@@ -267,23 +867,57 @@ func validateMnemonics(srcLines []srcLine) (bool, error) {
 
 // -----------------------------------------------------------------------------
 
+// getDataDirectiveNames returns a comma-separated, sorted list of all data
+// directive tokens and their aliases.
+func getDataDirectiveNames() string {
+	var names []string
+
+	for _, directiveToken := range directiveTokens {
+		names = append(names, directiveToken)
+	}
+
+	for alias, name := range mnemonicAliases {
+		if firstChar(name) == dataLineToken {
+			names = append(names, alias)
+		}
+	}
+
+	sort.Strings(names)
+
+	return strings.Join(names, ", ")
+}
+
+// -----------------------------------------------------------------------------
+
 // validateDataDirectives checks whether any invalid data directives exist.
-func validateDataDirectives(srcLines []srcLine) (bool, error) {
-	errMessageStart := ":\tInvalid "
+func (asm *assembly) validateDataDirectives(srcLines []srcLine) (bool, error) {
+	errMessageStart := "Invalid "
 	errMessageEnd := "-bit data in directive"
 
 	for _, srcLine := range srcLines {
+		if isValidDataDirective(srcLine.mnemonic) {
+			if strings.TrimSpace(srcLine.data) == "" {
+				return false, newAssembleError(srcLine.srcOrigin, srcLine.mnemonic, "Empty data directive "+srcLine.mnemonic+", write zero values explicitly")
+			}
+
+			for _, data := range asm.splitDataValues(srcLine.data) {
+				if strings.TrimSpace(data) == "" {
+					return false, newAssembleError(srcLine.srcOrigin, srcLine.data, "Empty value in data directive "+srcLine.data)
+				}
+			}
+		}
+
 		if srcLine.mnemonic == directiveTokens[data8BitDirective] {
-			splitData := strings.Split(srcLine.data, dataDlm)
+			splitData := asm.splitDataValues(srcLine.data)
 
 			if !is8BitHexStrings(splitData) {
-				return false, errors.New(strconv.Itoa(srcLine.lineNum+1) + errMessageStart + "8" + errMessageEnd)
+				return false, newAssembleError(srcLine.srcOrigin, srcLine.data, errMessageStart+"8"+errMessageEnd)
 			}
 		} else if srcLine.mnemonic == directiveTokens[data16BitDirective] {
-			splitData := strings.Split(srcLine.data, dataDlm)
+			splitData := asm.splitDataValues(srcLine.data)
 
 			if !is16BitHexStrings(splitData) {
-				return false, errors.New(strconv.Itoa(srcLine.lineNum+1) + errMessageStart + "16" + errMessageEnd)
+				return false, newAssembleError(srcLine.srcOrigin, srcLine.data, errMessageStart+"16"+errMessageEnd)
 			}
 		}
 	}
@@ -339,34 +973,87 @@ func is8BitHexString(hex string) bool {
 
 // -----------------------------------------------------------------------------
 
+// parseAlignBoundary parses the operand of an align directive, a power of two
+// given as a hexadecimal or decimal value, e.g. 100 or 256. Apart from single
+// digits, which are the same either way, no value is a power of two both ways.
+func parseAlignBoundary(op string) (uint64, bool) {
+	for _, base := range []int{16, 10} {
+		boundary, err := strconv.ParseUint(op, base, 16)
+		if err == nil && boundary != 0 && boundary&(boundary-1) == 0 {
+			return boundary, true
+		}
+	}
+
+	return 0, false
+}
+
+// -----------------------------------------------------------------------------
+
 // calcAddresses calculates the address for each instruction/directive based
-// on the program offset and instruction/data lengths.
-func calcAddresses(srcLines []srcLine, programOffset uint16) ([]srcLine, error) {
+// on the program offset and instruction/data lengths. Each bank directive
+// switches to a new bank, starting over at the program offset. Each align
+// directive is preceded by an 8-bit data directive with its padding, if any.
+func (asm *assembly) calcAddresses(srcLines []srcLine, programOffset uint16) ([]srcLine, error) {
 	var addressSrcLines []srcLine
 
 	programCounter := int(programOffset)
 
-	for _, srcLine := range srcLines {
-		currentSrcLine := srcLine
+	currentBank := 0
+	usedBanks := make(map[int]bool)
 
-		currentSrcLine.address = programCounter
+	for lineNum, srcLine := range srcLines {
+		currentSrcLine := srcLine
 
-		addressSrcLines = append(addressSrcLines, currentSrcLine)
+		if srcLine.mnemonic == bankToken {
+			if srcLine.op1Type != addressOp || !is8BitHexString(srcLine.op1) {
+				return nil, newAssembleError(srcLine.srcOrigin, srcLine.op1, "Invalid bank number "+srcLine.op1)
+			}
 
-		if isValidDataDirective(srcLine.mnemonic) {
-			splitData := strings.Split(srcLine.data, dataDlm)
+			bank, _ := strconv.ParseUint(srcLine.op1, 16, 8)
+			if usedBanks[int(bank)] {
+				return nil, newAssembleError(srcLine.srcOrigin, srcLine.op1, "Bank "+srcLine.op1+" already used")
+			}
 
-			if srcLine.mnemonic == directiveTokens[data8BitDirective] {
-				programCounter += len(splitData)
-			} else if srcLine.mnemonic == directiveTokens[data16BitDirective] {
-				programCounter += 2 * len(splitData)
+			currentBank = int(bank)
+			programCounter = int(programOffset)
+		} else if srcLine.mnemonic == alignToken {
+			boundary, valid := parseAlignBoundary(srcLine.op1)
+			if srcLine.op1Type != addressOp || !valid {
+				return nil, newAssembleError(srcLine.srcOrigin, srcLine.op1, "Invalid "+alignToken+" boundary "+srcLine.op1+", use a power of two")
 			}
-		} else {
-			programCounter += mnemonics[srcLine.mnemonic].instrLength
+
+			if padding := (int(boundary) - programCounter%int(boundary)) % int(boundary); padding > 0 {
+				paddingSrcLine := srcLine
+				paddingSrcLine.label, paddingSrcLine.stackedLabels = "", nil
+				paddingSrcLine.mnemonic = directiveTokens[data8BitDirective]
+				paddingSrcLine.op1Type, paddingSrcLine.op1 = invalidOp, ""
+				paddingSrcLine.data = strings.Repeat("00"+asm.opts.DataDlm, padding-1) + "00"
+				paddingSrcLine.address = programCounter
+				paddingSrcLine.bank = currentBank
+
+				addressSrcLines = append(addressSrcLines, paddingSrcLine)
+
+				programCounter += padding
+			}
+
+			usedBanks[currentBank] = true
+		} else {
+			usedBanks[currentBank] = true
 		}
 
-		if programCounter >= maxAddressSpace {
-			return nil, errors.New(strconv.Itoa(srcLine.lineNum+1) + ":\tAddress out of range")
+		currentSrcLine.address = programCounter
+		currentSrcLine.bank = currentBank
+
+		addressSrcLines = append(addressSrcLines, currentSrcLine)
+
+		programCounter += asm.getSrcLineLength(srcLine)
+
+		// The program may end right at the ceiling, i.e. its last byte may
+		// be just below it.
+		if programCounter > asm.target.maxAddressSpace {
+			size := programCounter - int(programOffset) + asm.getBankRestLength(srcLines[lineNum+1:])
+
+			return nil, newAssembleError(srcLine.srcOrigin, "", asm.describeOverflow(size, programOffset))
 		}
 	}
 
@@ -375,6 +1062,89 @@ func calcAddresses(srcLines []srcLine, programOffset uint16) ([]srcLine, error)
 
 // -----------------------------------------------------------------------------
 
+// describeOverflow describes a program too large to fit in the address space at
+// its offset for use in messages.
+func (asm *assembly) describeOverflow(size int, programOffset uint16) string {
+	return "Program of " + strconv.Itoa(size) + " bytes at offset " + strings.ToUpper(fmt.Sprintf("%04x", programOffset)) + " exceeds the address space, which ends below " + strings.ToUpper(fmt.Sprintf("%04x", asm.target.maxAddressSpace))
+}
+
+// -----------------------------------------------------------------------------
+
+// getBankRestLength calculates the number of bytes the given lines of source
+// code assemble to, up to the next bank directive, if any.
+func (asm *assembly) getBankRestLength(srcLines []srcLine) int {
+	length := 0
+
+	for _, srcLine := range srcLines {
+		if srcLine.mnemonic == bankToken {
+			break
+		}
+
+		length += asm.getSrcLineLength(srcLine)
+	}
+
+	return length
+}
+
+// -----------------------------------------------------------------------------
+
+// resolveSizeSymbols replaces the program size symbol in data directives with
+// the program size, which is only known once all addresses are calculated.
+func (asm *assembly) resolveSizeSymbols(srcLines []srcLine) ([]srcLine, error) {
+	size := 0
+	for _, srcLine := range srcLines {
+		size += asm.getSrcLineLength(srcLine)
+	}
+
+	var resolvedSrcLines []srcLine
+
+	for _, srcLine := range srcLines {
+		currentSrcLine := srcLine
+
+		if isValidDataDirective(srcLine.mnemonic) && strings.Contains(srcLine.data, sizeSymbol) {
+			splitData := asm.splitDataValues(srcLine.data)
+
+			for i, data := range splitData {
+				if data != sizeSymbol {
+					continue
+				}
+
+				if srcLine.mnemonic != directiveTokens[data16BitDirective] {
+					return nil, newAssembleError(srcLine.srcOrigin, sizeSymbol, sizeSymbol+" needs 16-bit data")
+				}
+
+				splitData[i] = strings.ToUpper(fmt.Sprintf("%04x", size))
+			}
+
+			currentSrcLine.data = strings.Join(splitData, asm.opts.DataDlm)
+		}
+
+		resolvedSrcLines = append(resolvedSrcLines, currentSrcLine)
+	}
+
+	return resolvedSrcLines, nil
+}
+
+// -----------------------------------------------------------------------------
+
+// getSrcLineLength calculates the number of bytes a line of source code
+// assembles to.
+func (asm *assembly) getSrcLineLength(srcLine srcLine) int {
+	if isValidDataDirective(srcLine.mnemonic) {
+		splitData := asm.splitDataValues(srcLine.data)
+
+		if srcLine.mnemonic == directiveTokens[data8BitDirective] {
+			return len(splitData)
+		}
+
+		return 2 * len(splitData)
+	}
+
+	return mnemonics[srcLine.mnemonic].instrLength
+}
+
+// -----------------------------------------------------------------------------
+
 // isValidDataDirective checks whether a mnemonic is a data directive.
 func isValidDataDirective(mnemonic string) bool {
 	return mnemonic == directiveTokens[data8BitDirective] || mnemonic == directiveTokens[data16BitDirective]
@@ -388,8 +1158,8 @@ func getLabelAddresses(srcLines []srcLine) map[string]int {
 	labelAddresses := make(map[string]int)
 
 	for _, srcLine := range srcLines {
-		if srcLine.label != "" {
-			labelAddresses[srcLine.label] = srcLine.address
+		for _, label := range getLineLabels(srcLine) {
+			labelAddresses[label] = srcLine.address
 		}
 	}
 
@@ -398,36 +1168,140 @@ func getLabelAddresses(srcLines []srcLine) map[string]int {
 
 // -----------------------------------------------------------------------------
 
-// expandLabels translates source labels into final addresses.
-func expandLabels(srcLines []srcLine, labelAddresses map[string]int) ([]srcLine, error) {
+// isBanked checks whether the source code uses bank directives.
+func isBanked(srcLines []srcLine) bool {
+	for _, srcLine := range srcLines {
+		if srcLine.mnemonic == bankToken {
+			return true
+		}
+	}
+
+	return false
+}
+
+// -----------------------------------------------------------------------------
+
+// getLabelBanks finds all source labels and returns them along with their
+// banks.
+func getLabelBanks(srcLines []srcLine) map[string]int {
+	labelBanks := make(map[string]int)
+
+	for _, srcLine := range srcLines {
+		for _, label := range getLineLabels(srcLine) {
+			labelBanks[label] = srcLine.bank
+		}
+	}
+
+	return labelBanks
+}
+
+// -----------------------------------------------------------------------------
+
+// printSymbols outputs all labels along with their addresses, sorted by
+// address. If label banks are given, addresses are prefixed with their bank
+// and sorted by bank first.
+func printSymbols(labelAddresses map[string]int, labelBanks map[string]int) {
+	var labels []string
+
+	for label := range labelAddresses {
+		labels = append(labels, label)
+	}
+
+	sort.Slice(labels, func(i, j int) bool {
+		if labelBanks[labels[i]] != labelBanks[labels[j]] {
+			return labelBanks[labels[i]] < labelBanks[labels[j]]
+		}
+
+		if labelAddresses[labels[i]] != labelAddresses[labels[j]] {
+			return labelAddresses[labels[i]] < labelAddresses[labels[j]]
+		}
+
+		return labels[i] < labels[j]
+	})
+
+	for _, label := range labels {
+		address := strings.ToUpper(fmt.Sprintf("%04x", labelAddresses[label]))
+		if labelBanks != nil {
+			address = strings.ToUpper(fmt.Sprintf("%02x", labelBanks[label])) + ":" + address
+		}
+
+		fmt.Println(address + "\t" + label)
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// expandLabels translates source labels into final addresses, recording where
+// absolute addresses end up for relocation.
+func (asm *assembly) expandLabels(srcLines []srcLine, labelAddresses map[string]int) ([]srcLine, error) {
 	var expandedSrcLines []srcLine
 
-	errMessageStart := ":\tLabel "
+	errMessageStart := "Label "
 	errMessageEnd := " not defined"
 
 	for _, srcLine := range srcLines {
 		currentSrcLine := srcLine
 
-		if srcLine.op1 != "" {
-			op1Label := getOpLabel(srcLine.op1)
+		if srcLine.op1 != "" && srcLine.op1Type == relativeOp {
+			op1Label := asm.getOpLabel(srcLine.op1)
+
+			if op1Label != "" {
+				if _, exists := labelAddresses[op1Label]; !exists {
+					return nil, newAssembleError(srcLine.srcOrigin, op1Label, errMessageStart+op1Label+errMessageEnd)
+				}
+
+				offset, err := getRelativeOffset(srcLine, labelAddresses[op1Label])
+				if err != nil {
+					return nil, err
+				}
+
+				currentSrcLine.op1 = asm.replaceOpLabel(currentSrcLine.op1, offset)
+				currentSrcLine.labelRefs = append(currentSrcLine.labelRefs, op1Label)
+			}
+		} else if srcLine.op1 != "" {
+			op1Label := asm.getOpLabel(srcLine.op1)
 
 			if op1Label != "" {
 				if _, exists := labelAddresses[op1Label]; exists {
-					currentSrcLine.op1 = strings.Replace(currentSrcLine.op1, op1Label, strings.ToUpper(fmt.Sprintf("%04x", labelAddresses[op1Label])), 1)
+					currentSrcLine.op1 = asm.replaceOpLabel(currentSrcLine.op1, strings.ToUpper(fmt.Sprintf("%04x", labelAddresses[op1Label])))
+					currentSrcLine.relocAddresses = append(currentSrcLine.relocAddresses, srcLine.address+1)
+					currentSrcLine.labelRefs = append(currentSrcLine.labelRefs, op1Label)
 				} else {
-					return nil, errors.New(strconv.Itoa(srcLine.lineNum+1) + errMessageStart + op1Label + errMessageEnd)
+					return nil, newAssembleError(srcLine.srcOrigin, op1Label, errMessageStart+op1Label+errMessageEnd)
 				}
 			}
 		}
 
 		if srcLine.op2 != "" {
-			op2Label := getOpLabel(srcLine.op2)
+			op2Label := asm.getOpLabel(srcLine.op2)
 
 			if op2Label != "" {
 				if _, exists := labelAddresses[op2Label]; exists {
-					currentSrcLine.op2 = strings.Replace(currentSrcLine.op2, op2Label, strings.ToUpper(fmt.Sprintf("%04x", labelAddresses[op2Label])), 1)
+					currentSrcLine.op2 = asm.replaceOpLabel(currentSrcLine.op2, strings.ToUpper(fmt.Sprintf("%04x", labelAddresses[op2Label])))
+					currentSrcLine.relocAddresses = append(currentSrcLine.relocAddresses, srcLine.address+3)
+					currentSrcLine.labelRefs = append(currentSrcLine.labelRefs, op2Label)
 				} else {
-					return nil, errors.New(strconv.Itoa(srcLine.lineNum+1) + errMessageStart + op2Label + errMessageEnd)
+					return nil, newAssembleError(srcLine.srcOrigin, op2Label, errMessageStart+op2Label+errMessageEnd)
+				}
+			}
+		}
+
+		if isValidDataDirective(srcLine.mnemonic) {
+			expandedData, dataLabels, err := asm.expandDataLabels(srcLine, labelAddresses)
+			if err != nil {
+				return nil, err
+			}
+
+			currentSrcLine.data = expandedData
+			currentSrcLine.labelRefs = append(currentSrcLine.labelRefs, dataLabels...)
+
+			if srcLine.mnemonic == directiveTokens[data16BitDirective] {
+				for i, data := range asm.splitDataValues(srcLine.data) {
+					cleanData := strings.TrimSpace(data)
+
+					if asm.isSrcLabel(cleanData) && !is16BitHexString(cleanData) {
+						currentSrcLine.relocAddresses = append(currentSrcLine.relocAddresses, srcLine.address+2*i)
+					}
 				}
 			}
 		}
@@ -440,48 +1314,310 @@ func expandLabels(srcLines []srcLine, labelAddresses map[string]int) ([]srcLine,
 
 // -----------------------------------------------------------------------------
 
-// getOpLabel finds a source label in an operand.
-func getOpLabel(op string) string {
-	reSrcLabel := regexp.MustCompile(`([\w.]{5,})`)
-	label := reSrcLabel.FindString(op)
+// warnOrphanedLabels warns about labels defined in the source code that are not
+// attached to any line of structured source code, and would therefore not
+// resolve to an address.
+func (asm *assembly) warnOrphanedLabels(srcLines []srcLine, labelOrigins map[string]srcOrigin) {
+	attachedLabels := make(map[string]bool)
+
+	for _, srcLine := range srcLines {
+		for _, label := range getLineLabels(srcLine) {
+			attachedLabels[label] = true
+		}
+	}
+
+	var labels []string
+
+	for label := range labelOrigins {
+		if !attachedLabels[label] {
+			labels = append(labels, label)
+		}
+	}
+
+	sort.Strings(labels)
+
+	for _, label := range labels {
+		asm.addWarning(labelOrigins[label], label, "Label "+label+" is not attached to any instruction or data")
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// warnSharedLabelAddresses warns about labels sharing the same address within
+// the same bank, naming the lines the labels are defined on.
+func (asm *assembly) warnSharedLabelAddresses(srcLines []srcLine, labelOrigins map[string]srcOrigin) {
+	var locations []int
+	locationLabels := make(map[int][]string)
+
+	for _, srcLine := range srcLines {
+		location := srcLine.bank<<16 | srcLine.address
+
+		for _, label := range getLineLabels(srcLine) {
+			if _, exists := locationLabels[location]; !exists {
+				locations = append(locations, location)
+			}
+
+			locationLabels[location] = append(locationLabels[location], label)
+		}
+	}
+
+	for _, location := range locations {
+		labels := locationLabels[location]
+		if len(labels) < 2 {
+			continue
+		}
+
+		var descrs []string
+		for _, label := range labels {
+			descrs = append(descrs, label+" ("+describeOrigin(labelOrigins[label])+")")
+		}
+
+		lastLabel := labels[len(labels)-1]
+		address := strings.ToUpper(fmt.Sprintf("%04x", location&0xFFFF))
 
-	return label
+		asm.addWarning(labelOrigins[lastLabel], lastLabel, "Labels "+strings.Join(descrs, ", ")+" share address "+address)
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// checkJumpTargets warns about jump family instructions whose label target
+// lies outside of the emitted program, lands on data or exceeds the address
+// space limit. Literal values and computed targets are not checked.
+func (asm *assembly) checkJumpTargets(srcLines []srcLine, labelAddresses map[string]int) {
+	if len(srcLines) == 0 {
+		return
+	}
+
+	dataAddresses := make(map[int]bool)
+
+	programStart := srcLines[0].address
+	programEnd := programStart
+
+	for _, srcLine := range srcLines {
+		if srcLine.address < programStart {
+			programStart = srcLine.address
+		}
+
+		if isValidDataDirective(srcLine.mnemonic) {
+			dataAddresses[srcLine.address] = true
+		}
+
+		if srcLine.address+asm.getSrcLineLength(srcLine) > programEnd {
+			programEnd = srcLine.address + asm.getSrcLineLength(srcLine)
+		}
+	}
+
+	for _, srcLine := range srcLines {
+		if !jumpMnemonics[srcLine.mnemonic] || (srcLine.op1Type != literalOp && srcLine.op1Type != relativeOp) {
+			continue
+		}
+
+		label := asm.getOpLabel(srcLine.op1)
+		target, exists := labelAddresses[label]
+		if !exists {
+			continue
+		}
+
+		targetHex := strings.ToUpper(fmt.Sprintf("%04x", target))
+
+		if target < programStart || target >= programEnd || target >= asm.target.maxAddressSpace {
+			asm.addWarning(srcLine.srcOrigin, label, "Jump target "+label+" ("+targetHex+") outside of program")
+		} else if dataAddresses[target] {
+			asm.addWarning(srcLine.srcOrigin, label, "Jump target "+label+" ("+targetHex+") is data")
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// getRelativeOffset calculates the signed 16-bit offset from the address of the
+// instruction following a line of source code to a target address.
+func getRelativeOffset(srcLine srcLine, targetAddress int) (string, error) {
+	offset := targetAddress - (srcLine.address + mnemonics[srcLine.mnemonic].instrLength)
+
+	if offset < -0x8000 || offset > 0x7FFF {
+		return "", newAssembleError(srcLine.srcOrigin, srcLine.op1, "Relative target "+srcLine.op1+" out of range")
+	}
+
+	return strings.ToUpper(fmt.Sprintf("%04x", uint16(offset))), nil
+}
+
+// -----------------------------------------------------------------------------
+
+// expandDataLabels translates labels in a data directive into their 16-bit
+// addresses, and label differences, such as table_end-table_start, into values
+// of the directive's width. The labels referenced are returned as well.
+func (asm *assembly) expandDataLabels(srcLine srcLine, labelAddresses map[string]int) (string, []string, error) {
+	reLabelDiff := regexp.MustCompile(`^(` + srcLabelChars + `+)` + labelDiffToken + `(` + srcLabelChars + `+)$`)
+
+	splitData := asm.splitDataValues(srcLine.data)
+
+	var dataLabels []string
+
+	for i, data := range splitData {
+		cleanData := strings.TrimSpace(data)
+
+		if asm.isSrcLabel(cleanData) && !is16BitHexString(cleanData) {
+			address, exists := labelAddresses[cleanData]
+			if !exists {
+				return "", nil, newAssembleError(srcLine.srcOrigin, cleanData, "Label "+cleanData+" not defined")
+			}
+
+			if srcLine.mnemonic != directiveTokens[data16BitDirective] {
+				return "", nil, newAssembleError(srcLine.srcOrigin, cleanData, "Label "+cleanData+" address needs 16-bit data")
+			}
+
+			splitData[i] = strings.ToUpper(fmt.Sprintf("%04x", address))
+			dataLabels = append(dataLabels, cleanData)
+
+			continue
+		}
+
+		labels := reLabelDiff.FindStringSubmatch(data)
+		if labels == nil || !asm.isSrcLabel(labels[1]) || !asm.isSrcLabel(labels[2]) {
+			continue
+		}
+
+		for _, label := range labels[1:] {
+			if _, exists := labelAddresses[label]; !exists {
+				return "", nil, newAssembleError(srcLine.srcOrigin, label, "Label "+label+" not defined")
+			}
+		}
+
+		dataLabels = append(dataLabels, labels[1:]...)
+
+		diff := labelAddresses[labels[1]] - labelAddresses[labels[2]]
+		if diff < 0 {
+			return "", nil, newAssembleError(srcLine.srcOrigin, data, "Negative label difference "+data)
+		}
+
+		if srcLine.mnemonic == directiveTokens[data8BitDirective] {
+			if diff > 0xFF {
+				return "", nil, newAssembleError(srcLine.srcOrigin, data, "Label difference "+data+" exceeds 8-bit data")
+			}
+
+			splitData[i] = strings.ToUpper(fmt.Sprintf("%02x", diff))
+		} else {
+			splitData[i] = strings.ToUpper(fmt.Sprintf("%04x", diff))
+		}
+	}
+
+	return strings.Join(splitData, asm.opts.DataDlm), dataLabels, nil
+}
+
+// -----------------------------------------------------------------------------
+
+// getOpLabel finds a source label in an operand. Source labels are longer than
+// any 16-bit hexadecimal value, so operand values are never taken for labels.
+func (asm *assembly) getOpLabel(op string) string {
+	start, end := asm.getOpLabelSpan(op)
+
+	return op[start:end]
+}
+
+// -----------------------------------------------------------------------------
+
+// getOpLabelSpan finds the start and end of the source label getOpLabel finds
+// in an operand, both 0 if there is none.
+func (asm *assembly) getOpLabelSpan(op string) (int, int) {
+	reSrcLabel := regexp.MustCompile(`(` + asm.getSrcLabelPattern() + `)`)
+
+	span := reSrcLabel.FindStringIndex(op)
+	if span == nil {
+		return 0, 0
+	}
+
+	return span[0], span[1]
+}
+
+// -----------------------------------------------------------------------------
+
+// replaceOpLabel replaces exactly the source label getOpLabel finds in an
+// operand, so that a label is never replaced inside a longer token that merely
+// contains it.
+func (asm *assembly) replaceOpLabel(op string, replacement string) string {
+	start, end := asm.getOpLabelSpan(op)
+	if start == end {
+		return op
+	}
+
+	return op[:start] + replacement + op[end:]
 }
 
 // -----------------------------------------------------------------------------
 
 // validateOps checks whether any erroneous operands exist.
-func validateOps(srcLines []srcLine) (bool, error) {
-	errMessage := ":\tInvalid operand "
+func (asm *assembly) validateOps(srcLines []srcLine) (bool, error) {
+	errMessage := "Invalid operand "
 
 	for _, srcLine := range srcLines {
 		if !isValidDataDirective(srcLine.mnemonic) {
+			if srcLine.unexpected != "" {
+				token := strings.Fields(srcLine.unexpected)[0]
+
+				return false, newAssembleError(srcLine.srcOrigin, token, "Unexpected token "+rawToken(srcLine.rawLine, token))
+			}
+
+			if srcLine.mnemonic == noteToken {
+				if !isDataString(srcLine.data) {
+					return false, newAssembleError(srcLine.srcOrigin, srcLine.mnemonic, srcLine.mnemonic+" needs a string")
+				}
+
+				continue
+			}
+
+			_, err := validateOpPrefixes(srcLine)
+			if err != nil {
+				return false, err
+			}
+
 			switch mnemonics[srcLine.mnemonic].numOps {
 			case 0:
 				if srcLine.op1 != "" || srcLine.op2 != "" {
-					return false, errors.New(strconv.Itoa(srcLine.lineNum+1) + ":\t" + srcLine.mnemonic + " needs no operands")
+					return false, newAssembleError(srcLine.srcOrigin, srcLine.mnemonic, srcLine.mnemonic+" needs no operands")
 				}
 			case 1:
 				if srcLine.op1 == "" || srcLine.op2 != "" {
-					return false, errors.New(strconv.Itoa(srcLine.lineNum+1) + ":\t" + srcLine.mnemonic + " needs one operand")
+					return false, newAssembleError(srcLine.srcOrigin, srcLine.mnemonic, srcLine.mnemonic+" needs one operand")
 				}
 			case 2:
 				if srcLine.op1 == "" || srcLine.op2 == "" {
-					return false, errors.New(strconv.Itoa(srcLine.lineNum+1) + ":\t" + srcLine.mnemonic + " needs two operands")
+					return false, newAssembleError(srcLine.srcOrigin, srcLine.mnemonic, srcLine.mnemonic+" needs two operands")
 				}
 			}
 
 			if srcLine.op1 != "" && !isValidHexString(srcLine.op1) {
-				return false, errors.New(strconv.Itoa(srcLine.lineNum+1) + errMessage + srcLine.op1)
+				return false, newAssembleError(srcLine.srcOrigin, srcLine.op1, errMessage+srcLine.op1)
 			}
 
 			if srcLine.op2 != "" && !isValidHexString(srcLine.op2) {
-				return false, errors.New(strconv.Itoa(srcLine.lineNum+1) + errMessage + srcLine.op2)
+				return false, newAssembleError(srcLine.srcOrigin, srcLine.op2, errMessage+srcLine.op2)
+			}
+
+			allowedOpTypes := mnemonicOpTypes[srcLine.mnemonic]
+
+			if srcLine.op1 != "" && !allowedOpTypes[0][srcLine.op1Type] {
+				return false, newAssembleError(srcLine.srcOrigin, opTokens[srcLine.op1Type]+srcLine.op1, "Invalid operand type "+getOpDescr(srcLine.op1Type)+" for "+srcLine.mnemonic)
 			}
 
-			if srcLine.op2 != "" && srcLine.op2Type == literalOp {
-                return false, errors.New(strconv.Itoa(srcLine.lineNum+1) + ":\tInvalid target operand type " + opDescr[literalOp])
+			if srcLine.op2 != "" && !allowedOpTypes[1][srcLine.op2Type] {
+				return false, newAssembleError(srcLine.srcOrigin, opTokens[srcLine.op2Type]+srcLine.op2, "Invalid target operand type "+getOpDescr(srcLine.op2Type)+" for "+srcLine.mnemonic)
 			}
+
+			_, err = validatePointers(srcLine)
+			if err != nil {
+				return false, err
+			}
+
+			if divisionMnemonics[srcLine.mnemonic] && srcLine.op1Type == literalOp {
+				divisor, _ := strconv.ParseUint(srcLine.op1, 16, 16)
+				if divisor == 0 {
+					asm.addWarning(srcLine.srcOrigin, opTokens[literalOp]+srcLine.op1, "Division by literal zero in "+srcLine.mnemonic)
+				}
+			}
+
+			asm.warnAddressCeiling(srcLine)
 		}
 	}
 
@@ -490,6 +1626,139 @@ func validateOps(srcLines []srcLine) (bool, error) {
 
 // -----------------------------------------------------------------------------
 
+// validatePointers checks whether the pointer operands of an instruction are
+// plausible 16-bit addresses. A pointer written with no more than two digits
+// looks like an 8-bit literal with the wrong prefix, so pointers to addresses
+// below 0100 need leading zeros. A pointer to FFFF leaves no room for the
+// 16-bit address it points to.
+func validatePointers(srcLine srcLine) (bool, error) {
+	types := []opType{srcLine.op1Type, srcLine.op2Type}
+
+	for i, op := range []string{srcLine.op1, srcLine.op2} {
+		if types[i] != pointerOp {
+			continue
+		}
+
+		token := opTokens[pointerOp] + op
+
+		if is8BitHexString(op) {
+			return false, newAssembleError(srcLine.srcOrigin, token, "Pointer "+token+" looks like an 8-bit literal, write "+opTokens[literalOp]+op+" for a literal or "+opTokens[pointerOp]+strings.ToUpper(fmt.Sprintf("%04s", op))+" for a pointer")
+		}
+
+		if address, _ := strconv.ParseUint(op, 16, 16); address == 0xFFFF {
+			return false, newAssembleError(srcLine.srcOrigin, token, "Pointer "+token+" leaves no room for a 16-bit address")
+		}
+	}
+
+	return true, nil
+}
+
+// -----------------------------------------------------------------------------
+
+// validateOpPrefixes checks whether the prefixed operands of an instruction,
+// i.e. literals, pointers and relative operands, have a value following a
+// single prefix.
+func validateOpPrefixes(srcLine srcLine) (bool, error) {
+	types := []opType{srcLine.op1Type, srcLine.op2Type}
+
+	for i, op := range []string{srcLine.op1, srcLine.op2} {
+		prefix, isPrefixed := opTokens[types[i]]
+		if !isPrefixed {
+			continue
+		}
+
+		if op == "" {
+			return false, newAssembleError(srcLine.srcOrigin, prefix, "Operand prefix "+prefix+" without a value")
+		}
+
+		if getOpType(op) != addressOp {
+			return false, newAssembleError(srcLine.srcOrigin, prefix+op, "Stacked operand prefixes in "+prefix+op)
+		}
+	}
+
+	return true, nil
+}
+
+// -----------------------------------------------------------------------------
+
+// warnAddressCeiling warns about address and pointer operands of an
+// instruction at or above the address space limit, i.e. within the call stack
+// or beyond memory. Special addresses are exempt, as are literal operands.
+func (asm *assembly) warnAddressCeiling(srcLine srcLine) {
+	if srcLine.mnemonic == bankToken || srcLine.mnemonic == alignToken {
+		return
+	}
+
+	specialFirst, specialLast := asm.target.getSpecialAddressRange()
+
+	types := []opType{srcLine.op1Type, srcLine.op2Type}
+
+	for i, op := range []string{srcLine.op1, srcLine.op2} {
+		if op == "" || (types[i] != addressOp && types[i] != pointerOp) {
+			continue
+		}
+
+		address, _ := strconv.ParseUint(op, 16, 16)
+
+		if int(address) >= asm.target.maxAddressSpace && (int(address) < specialFirst || int(address) > specialLast) {
+			addressHex := strings.ToUpper(fmt.Sprintf("%04x", address))
+			limitHex := strings.ToUpper(fmt.Sprintf("%04x", asm.target.maxAddressSpace))
+
+			asm.addWarning(srcLine.srcOrigin, opTokens[types[i]]+op, "Address "+addressHex+" is outside the address space, which ends below "+limitHex)
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// validateOpWidths checks whether any 8-bit instruction has a hexadecimal literal
+// operand that does not fit in 8 bits, rather than silently truncating it.
+// Labels are not checked.
+func validateOpWidths(srcLines []srcLine) (bool, error) {
+	for _, srcLine := range srcLines {
+		wideMnemonic, is8Bit := get16BitMnemonic(srcLine.mnemonic)
+		if !is8Bit {
+			continue
+		}
+
+		types := []opType{srcLine.op1Type, srcLine.op2Type}
+
+		for i, op := range []string{srcLine.op1, srcLine.op2} {
+			if types[i] != literalOp || !isValidHexString(op) {
+				continue
+			}
+
+			value, _ := strconv.ParseUint(op, 16, 16)
+			if value > 0xFF {
+				token := opTokens[literalOp] + op
+
+				return false, newAssembleError(srcLine.srcOrigin, token, "Literal "+token+" does not fit in 8 bits for "+srcLine.mnemonic+", use "+wideMnemonic+" instead")
+			}
+		}
+	}
+
+	return true, nil
+}
+
+// -----------------------------------------------------------------------------
+
+// get16BitMnemonic returns the 16-bit counterpart of an 8-bit instruction, and
+// whether the instruction is an 8-bit one.
+func get16BitMnemonic(name string) (string, bool) {
+	if !strings.HasSuffix(name, "8") {
+		return "", false
+	}
+
+	wideName := strings.TrimSuffix(name, "8") + "16"
+	if _, exists := mnemonics[wideName]; !exists {
+		return "", false
+	}
+
+	return wideName, true
+}
+
+// -----------------------------------------------------------------------------
+
 // isValidHexString checks whether a string is a valid hexadecimal number.
 func isValidHexString(hex string) bool {
 	if is16BitHexString(hex) || is8BitHexString(hex) {
@@ -501,45 +1770,86 @@ func isValidHexString(hex string) bool {
 
 // -----------------------------------------------------------------------------
 
-// printStructSrc prints out structured source code for debugging purposes.
+// formatStructSrc formats structured source code for StructSrc, one line per
+// element. Operands keep their type prefixes.
+func formatStructSrc(srcLines []srcLine) []string {
+	var structSrc []string
+
+	banked := isBanked(srcLines)
+
+	for _, srcLine := range srcLines {
+		address := strings.ToUpper(fmt.Sprintf("%04x", srcLine.address))
+		if banked {
+			address = strings.ToUpper(fmt.Sprintf("%02x", srcLine.bank)) + ":" + address
+		}
+
+		var ops []string
+		for i, op := range []string{srcLine.op1, srcLine.op2} {
+			opType := []opType{srcLine.op1Type, srcLine.op2Type}[i]
+			if opType != invalidOp {
+				ops = append(ops, opTokens[opType]+op)
+			}
+		}
+
+		operands := strings.Join(ops, opDlm)
+		if isValidDataDirective(srcLine.mnemonic) {
+			operands = srcLine.data
+		}
+
+		structSrc = append(structSrc, strings.Join([]string{
+			formatOriginRef(srcLine.srcOrigin),
+			address,
+			strings.Join(getLineLabels(srcLine), " "),
+			srcLine.mnemonic,
+			operands,
+		}, "\t"))
+	}
+
+	return structSrc
+}
+
+// -----------------------------------------------------------------------------
+
+// printStructSrc prints out structured source code to standard error for
+// debugging purposes.
 func printStructSrc(message string, srcLines []srcLine) {
 	if DEBUG {
-		fmt.Println(message)
+		fmt.Fprintln(os.Stderr, message)
 
 		for _, srcLine := range srcLines {
-			fmt.Print(srcLine.lineNum)
-			fmt.Print("\t")
-			fmt.Print(strings.ToUpper(fmt.Sprintf("%04x", srcLine.address)))
-			fmt.Print("\t")
-			if srcLine.label != "" {
-				fmt.Println(srcLine.label)
-				fmt.Print("\t\t")
-			}
-			fmt.Print(srcLine.mnemonic + "\t")
+			fmt.Fprint(os.Stderr, srcLine.lineNum)
+			fmt.Fprint(os.Stderr, "\t")
+			fmt.Fprint(os.Stderr, strings.ToUpper(fmt.Sprintf("%04x", srcLine.address)))
+			fmt.Fprint(os.Stderr, "\t")
+			for _, label := range getLineLabels(srcLine) {
+				fmt.Fprintln(os.Stderr, label)
+				fmt.Fprint(os.Stderr, "\t\t")
+			}
+			fmt.Fprint(os.Stderr, srcLine.mnemonic+"\t")
 			if srcLine.op1 != "" {
 				if srcLine.op1Type != invalidOp {
-					fmt.Print("(" + getOpDescr(srcLine.op1Type) + ")")
+					fmt.Fprint(os.Stderr, "("+getOpDescr(srcLine.op1Type)+")")
 				}
-				fmt.Print(srcLine.op1)
+				fmt.Fprint(os.Stderr, srcLine.op1)
 
 				if srcLine.op2 != "" {
-					fmt.Print(opDlm)
+					fmt.Fprint(os.Stderr, opDlm)
 					if srcLine.op2Type != invalidOp {
-						fmt.Print("(" + getOpDescr(srcLine.op2Type) + ")")
+						fmt.Fprint(os.Stderr, "("+getOpDescr(srcLine.op2Type)+")")
 					}
-					fmt.Print(srcLine.op2)
+					fmt.Fprint(os.Stderr, srcLine.op2)
 				}
 			} else {
-				fmt.Print(srcLine.data)
+				fmt.Fprint(os.Stderr, srcLine.data)
 			}
 			if len(srcLine.bin) > 0 {
-				fmt.Print(" -> ")
+				fmt.Fprint(os.Stderr, " -> ")
 
 				for _, currentByte := range srcLine.bin {
-					fmt.Print(strings.ToUpper(fmt.Sprintf("%02x", currentByte)) + " ")
+					fmt.Fprint(os.Stderr, strings.ToUpper(fmt.Sprintf("%02x", currentByte))+" ")
 				}
 			}
-			fmt.Println()
+			fmt.Fprintln(os.Stderr)
 		}
 	}
 }
@@ -0,0 +1,74 @@
+/*
+Copyright 2018-2019 Juan Irming
+
+This file is part of rasm16.
+
+rasm16 is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+rasm16 is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with rasm16.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package assemble
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// -----------------------------------------------------------------------------
+
+// Whether to build a relocation table during assembly.
+var BuildRelocTable bool = false
+
+// Relocation table built during the most recent assembly, holding the offset
+// of every 16-bit absolute address resolved from a label, relative to the start
+// of the program, i.e. excluding the header.
+var RelocOffsets []uint16
+
+// -----------------------------------------------------------------------------
+
+// buildRelocTable collects the relocation offsets of structured source code.
+func buildRelocTable(srcLines []srcLine, programOffset uint16) ([]uint16, error) {
+	if isBanked(srcLines) {
+		return nil, errors.New("Relocation tables are not supported for banked programs")
+	}
+
+	var relocOffsets []uint16
+
+	for _, srcLine := range srcLines {
+		for _, address := range srcLine.relocAddresses {
+			relocOffsets = append(relocOffsets, uint16(address-int(programOffset)))
+		}
+	}
+
+	sort.Slice(relocOffsets, func(i, j int) bool {
+		return relocOffsets[i] < relocOffsets[j]
+	})
+
+	return relocOffsets, nil
+}
+
+// -----------------------------------------------------------------------------
+
+// FormatRelocTable formats relocation offsets as 16-bit hexadecimal values, one
+// per line.
+func FormatRelocTable(relocOffsets []uint16) []string {
+	var lines []string
+
+	for _, offset := range relocOffsets {
+		lines = append(lines, strings.ToUpper(fmt.Sprintf("%04x", offset)))
+	}
+
+	return lines
+}
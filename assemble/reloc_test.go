@@ -0,0 +1,56 @@
+/*
+Copyright 2018-2019 Juan Irming
+
+This file is part of rasm16.
+
+rasm16 is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+rasm16 is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with rasm16.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package assemble
+
+import (
+	"strings"
+	"testing"
+)
+
+// -----------------------------------------------------------------------------
+
+// TestRelocTable builds the relocation table of a program with absolute label
+// references in both operands and in data, next to a relative reference and a
+// plain value, which need no relocation.
+func TestRelocTable(t *testing.T) {
+	src := []string{
+		"first_label",
+		"    CO   $first_label,second_label",
+		"    JM   ~first_label",
+		"second_label",
+		"    $16  first_label,1234,second_label",
+	}
+
+	srcLines, programOffset, _, err := newAssembly(DefaultOptions()).buildValidatedSrc([][]string{src}, []string{"selftest_reloc.rasm"}, 0x1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	relocOffsets, err := buildRelocTable(srcLines, programOffset)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"0001", "0003", "0008", "000C"}
+
+	if relocTable := FormatRelocTable(relocOffsets); strings.Join(relocTable, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Relocation table mismatch, expected %v, got %v", expected, relocTable)
+	}
+}
@@ -0,0 +1,167 @@
+/*
+Copyright 2018-2019 Juan Irming
+
+This file is part of rasm16.
+
+rasm16 is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+rasm16 is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with rasm16.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package assemble
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// -----------------------------------------------------------------------------
+
+// REPL source name, used for label namespaces.
+const replSrcName string = "repl"
+
+// -----------------------------------------------------------------------------
+
+// Repl reads rasm source code from standard input one line at a time and
+// prints the address and bytes each line assembles to, keeping track of the
+// program counter and of the labels and preprocessor constants defined so far.
+// Errors and warnings are printed without ending the session.
+func Repl(programOffset uint16) error {
+	asm := newAssembly(currentOptions())
+
+	err := validateOptions(asm.opts)
+	if err != nil {
+		return err
+	}
+
+	labelAddresses := make(map[string]int)
+	programCounter := int(programOffset)
+	pendingLabel := ""
+
+	scanner := bufio.NewScanner(os.Stdin)
+
+	for lineNum := 0; scanner.Scan(); lineNum++ {
+		label, srcLines, err := asm.assembleReplLine(scanner.Text(), lineNum, programCounter, labelAddresses, pendingLabel)
+
+		for _, warning := range asm.warnings {
+			fmt.Fprintln(os.Stderr, warning)
+		}
+		asm.warnings = nil
+
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+
+			continue
+		}
+
+		pendingLabel = label
+
+		for _, srcLine := range srcLines {
+			if srcLine.label != "" {
+				labelAddresses[srcLine.label] = srcLine.address
+			}
+
+			fmt.Println(strings.ToUpper(fmt.Sprintf("%04x", srcLine.address)) + "\t" + formatBytes(srcLine.bin))
+
+			programCounter = srcLine.address + len(srcLine.bin)
+		}
+	}
+
+	return scanner.Err()
+}
+
+// -----------------------------------------------------------------------------
+
+// assembleReplLine assembles a single line of source code at the program
+// counter. A label line is not assembled but returned, to be attached to the
+// next line, along with any pending label that was not attached yet.
+func (asm *assembly) assembleReplLine(rawLine string, lineNum int, programCounter int, labelAddresses map[string]int, pendingLabel string) (string, []srcLine, error) {
+	origins := newSrcOrigins("", []string{rawLine})
+	origins[0].lineNum = lineNum
+
+	rawSrcLines := asm.cleanSrc([]string{rawLine})
+
+	rawSrcLines, err := asm.expandConsts(rawSrcLines, origins, replSrcName)
+	if err != nil {
+		return pendingLabel, nil, err
+	}
+
+	rawSrcLines = asm.addSrcLabelNamespaces(rawSrcLines, replSrcName)
+
+	if rawSrcLines[0] == "" {
+		return pendingLabel, nil, nil
+	}
+
+	if asm.isSrcLabel(rawSrcLines[0]) {
+		if _, exists := labelAddresses[rawSrcLines[0]]; exists || rawSrcLines[0] == pendingLabel {
+			return pendingLabel, nil, newAssembleError(origins[0], rawSrcLines[0], "Duplicate label "+rawSrcLines[0])
+		}
+
+		return rawSrcLines[0], nil, nil
+	}
+
+	srcLines := asm.buildStructSrc(rawSrcLines, origins)
+	if len(srcLines) > 0 {
+		srcLines[0].label = pendingLabel
+	}
+
+	srcLines = unaliasMnemonics(srcLines)
+
+	srcLines, err = asm.convDataStringsToHex(srcLines)
+	if err != nil {
+		return pendingLabel, nil, err
+	}
+
+	srcLines, err = asm.expandDataNullRepeats(srcLines)
+	if err != nil {
+		return pendingLabel, nil, err
+	}
+
+	_, err = validateMnemonics(srcLines)
+	if err != nil {
+		return pendingLabel, nil, err
+	}
+
+	_, err = validateOpWidths(srcLines)
+	if err != nil {
+		return pendingLabel, nil, err
+	}
+
+	srcLines, err = asm.calcAddresses(srcLines, uint16(programCounter))
+	if err != nil {
+		return pendingLabel, nil, err
+	}
+
+	lineLabelAddresses := getLabelAddresses(srcLines)
+	for label, address := range labelAddresses {
+		lineLabelAddresses[label] = address
+	}
+
+	srcLines, err = asm.expandLabels(srcLines, lineLabelAddresses)
+	if err != nil {
+		return pendingLabel, nil, err
+	}
+
+	_, err = asm.validateDataDirectives(srcLines)
+	if err != nil {
+		return pendingLabel, nil, err
+	}
+
+	_, err = asm.validateOps(srcLines)
+	if err != nil {
+		return pendingLabel, nil, err
+	}
+
+	return "", asm.buildBinSrcLines(srcLines), nil
+}
@@ -0,0 +1,176 @@
+/*
+Copyright 2018-2019 Juan Irming
+
+This file is part of rasm16.
+
+rasm16 is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+rasm16 is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with rasm16.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package assemble
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// -----------------------------------------------------------------------------
+
+// Test program definition, used by the self-test and the package tests.
+type testProgram struct {
+	srcName     string
+	offset      uint16
+	commentChar string // Comment character, the default if empty.
+	src         []string
+	bin         []byte   // Expected binary, excluding the header.
+	warnings    []string // Expected warning messages, if any.
+}
+
+// Self-test program, covering general instructions, operands and data
+// directives.
+var selfTestProgram = testProgram{
+	srcName: "selftest.rasm",
+	offset:  0x1000,
+	src: []string{
+		"start",
+		"    CO   $message,[GP0]",
+		"    AD8  $1,*[GP0]",
+		"    SR16 $2,count",
+		"    CM8  $0,[GP0L]",
+		"    NE   $start",
+		"    RT   $[NULL]",
+		"",
+		"message",
+		`    $8   "OK\n"`,
+		"msg_end",
+		"    $16  msg_end-message",
+		"count",
+		"    $    1234",
+	},
+	bin: []byte{
+		0x10, 0x10, 0x1A, 0xFF, 0xF0, // CO
+		0x19, 0x00, 0x01, 0xFF, 0xF0, // AD8
+		0xA0, 0x00, 0x02, 0x10, 0x21, // SR16
+		0xA8, 0x00, 0x00, 0xFF, 0xF1, // CM8
+		0xC0, 0x10, 0x00, // NE
+		0xF8, 0x00, 0x00, // RT
+		0x22, 0x4F, 0x4B, 0x0A, 0x22, // message
+		0x00, 0x05, // msg_end
+		0x12, 0x34, // count
+	},
+}
+
+// -----------------------------------------------------------------------------
+
+// SelfTest verifies that the instruction set is consistent and that a small
+// embedded program assembles to a known binary using the default options. The
+// package tests cover much more.
+func SelfTest() error {
+	err := validateOpcodes()
+	if err != nil {
+		return err
+	}
+
+	asm := newAssembly(DefaultOptions())
+
+	bin, err := asm.assembleFiles([][]string{selfTestProgram.src}, []string{selfTestProgram.srcName}, selfTestProgram.offset)
+	if err != nil {
+		return err
+	}
+
+	return checkTestProgram(selfTestProgram, bin, asm.warnings)
+}
+
+// -----------------------------------------------------------------------------
+
+// checkTestProgram compares the binary and warnings resulting from a test
+// program assembled with the default options with the expected header, binary
+// and warnings.
+func checkTestProgram(program testProgram, bin []byte, assembleWarnings []AssembleError) error {
+	header, err := ReadHeader(bin)
+	if err != nil {
+		return err
+	}
+
+	if header.Version != DefaultOptions().HeaderVersion || header.ProgramOffset != program.offset {
+		return errors.New("Self-test header mismatch, got " + formatBytes(bin[:header.Length]))
+	}
+
+	if !bytes.Equal(bin[header.Length:], program.bin) {
+		return errors.New("Self-test binary mismatch, expected " + formatBytes(program.bin) + ", got " + formatBytes(bin[header.Length:]))
+	}
+
+	var warnings []string
+	for _, warning := range assembleWarnings {
+		warnings = append(warnings, warning.Message)
+	}
+
+	if strings.Join(warnings, "\n") != strings.Join(program.warnings, "\n") {
+		return errors.New("Self-test warnings mismatch, expected \"" + strings.Join(program.warnings, "; ") + "\", got \"" + strings.Join(warnings, "; ") + "\"")
+	}
+
+	return nil
+}
+
+// -----------------------------------------------------------------------------
+
+// validateOpcodes checks whether any two instructions share an opcode, and
+// whether every mnemonic has allowed operand types and a cycle count defined.
+func validateOpcodes() error {
+	opcodeMnemonics := make(map[byte]string)
+
+	for name, mnemonic := range mnemonics {
+		if len(mnemonicOpTypes[name]) != mnemonic.numOps {
+			return errors.New("Operand types for " + name + " do not match its number of operands")
+		}
+
+		if _, exists := mnemonicCycles[name]; !exists {
+			return errors.New("Cycle count for " + name + " not defined")
+		}
+
+		if mnemonic.instrLength == 0 {
+			continue
+		}
+
+		if mnemonic.opcode > maxOpcode {
+			return errors.New("Opcode " + formatBytes([]byte{mnemonic.opcode}) + " of " + name + " out of range")
+		}
+
+		if mnemonic.instrLength != 1+2*mnemonic.numOps {
+			return errors.New("Instruction length of " + name + " does not match its number of operands")
+		}
+
+		if otherName, exists := opcodeMnemonics[mnemonic.opcode]; exists {
+			return errors.New("Opcode " + formatBytes([]byte{mnemonic.opcode}) + " shared by " + otherName + " and " + name)
+		}
+
+		opcodeMnemonics[mnemonic.opcode] = name
+	}
+
+	return nil
+}
+
+// -----------------------------------------------------------------------------
+
+// formatBytes formats a byte slice as space-separated hexadecimal values.
+func formatBytes(bin []byte) string {
+	var hex []string
+
+	for _, currentByte := range bin {
+		hex = append(hex, strings.ToUpper(fmt.Sprintf("%02x", currentByte)))
+	}
+
+	return strings.Join(hex, " ")
+}
@@ -20,7 +20,9 @@ along with rasm16.  If not, see <http://www.gnu.org/licenses/>.
 package assemble
 
 import (
+	"errors"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
@@ -32,13 +34,32 @@ const (
 	opDlm         string = ","
 )
 
-// Minimum number of characters allowed in a source label.
-const srcLabelMinLen = 5
+// Default delimiter between instructions sharing a line of source code.
+const defaultInstrDlm string = ";"
+
+// Delimiter between instructions sharing a line of source code.
+var InstrDlm string = defaultInstrDlm
+
+// Default minimum number of characters allowed in a source label.
+const defaultSrcLabelMinLen int = 5
+
+// Minimum number of characters allowed in a source label, see
+// defaultSrcLabelMinLen.
+var SrcLabelMinLen int = defaultSrcLabelMinLen
+
+// Characters allowed in a source label, as a regular expression character
+// class.
+const srcLabelChars string = `[\w.]`
+
+// Mnemonic of the zero-length line that labels trailing the source code are
+// attached to, making them resolve to the end address of the program.
+const endOfSrcMnemonic string = ""
 
 // Structured source line definition.
 type srcLine struct {
-	lineNum  int
+	srcOrigin
 	label    string
+	bank     int
 	address  int
 	mnemonic string
 	op1Type  opType
@@ -47,45 +68,125 @@ type srcLine struct {
 	op2      string
 	data     string
 	bin      []byte
+
+	unexpected     string   // Stray content following the operands, if any.
+	stackedLabels  []string // Labels directly preceding label, sharing its address.
+	relocAddresses []int    // Addresses of 16-bit values resolved from labels.
+	labelRefs      []string // Labels referenced by operands or data.
+}
+
+// -----------------------------------------------------------------------------
+
+// validateInstrDlm checks whether an instruction delimiter can be told apart
+// from instructions, from the comment character and from other source code
+// syntax. A comment character clashing with it would silently turn every
+// instruction after the first on a line into a comment.
+func validateInstrDlm(dlm string, commentChar string) error {
+	if dlm == "" {
+		return errors.New("Instruction delimiter cannot be empty")
+	}
+
+	if strings.Contains(dlm, commentChar) || strings.Contains(commentChar, dlm) {
+		return errors.New("Instruction delimiter " + dlm + " clashes with comment character " + commentChar)
+	}
+
+	reReserved := regexp.MustCompile(`[\w\s.,()\-+*/\[\]"'\\$~:<#]`)
+
+	if reReserved.MatchString(dlm) {
+		return errors.New("Instruction delimiter " + dlm + " clashes with source code syntax")
+	}
+
+	return nil
+}
+
+// -----------------------------------------------------------------------------
+
+// validateSrcLabelMinLen checks whether labels of the minimum length can be told
+// apart from 16-bit hexadecimal values, which take four digits.
+func validateSrcLabelMinLen(minLen int) error {
+	if minLen <= 4 {
+		return errors.New("Minimum label length " + strconv.Itoa(minLen) + " clashes with 16-bit hexadecimal values, use at least 5")
+	}
+
+	return nil
 }
 
 // -----------------------------------------------------------------------------
 
 // buildStructSrc converts processed source lines to structured source code.
-func buildStructSrc(srcLines []string) []srcLine {
+// Labels at the very end of the source code resolve to the end address of the
+// program rather than being dropped.
+func (asm *assembly) buildStructSrc(srcLines []string, origins []srcOrigin) []srcLine {
 	var structSrcLines []srcLine
 
 	for lineNum, srcLineString := range srcLines {
-		if srcLineString != "" && !isSrcLabel(srcLineString) {
-			srcLabel := getSrcLabel(srcLines, lineNum)
-			currentSrcLine := srcLine{}
+		if srcLineString != "" && !asm.isSrcLabel(srcLineString) {
+			var srcLabel string
+			var stackedLabels []string
 
-			mnemonic, op1, op2, data := "", "", "", ""
-			var op1Type, op2Type opType
-
-			if isSrcDataLine(srcLineString) {
-				mnemonic, data = splitSrcDataLine(srcLineString)
-			} else {
-				mnemonic, op1, op2 = splitSrcCodeLine(srcLineString)
-				mnemonic = strings.ToUpper(mnemonic)
-
-				op1Type, op1 = splitOp(op1)
-				op2Type, op2 = splitOp(op2)
+			if srcLabels := asm.getSrcLabels(srcLines, lineNum); len(srcLabels) > 0 {
+				srcLabel = srcLabels[len(srcLabels)-1]
+				stackedLabels = srcLabels[:len(srcLabels)-1]
 			}
 
-			currentSrcLine = srcLine{
-				lineNum:  lineNum,
-				label:    srcLabel,
-				mnemonic: mnemonic,
-				op1Type:  op1Type,
-				op1:      op1,
-				op2Type:  op2Type,
-				op2:      op2,
-				data:     data,
+			for _, instrString := range splitUnquoted(srcLineString, asm.opts.InstrDlm) {
+				instrString = strings.TrimSpace(instrString)
+				if instrString == "" {
+					continue
+				}
+
+				mnemonic, op1, op2, data, unexpected := "", "", "", "", ""
+				var op1Type, op2Type opType
+
+				if isSrcDataLine(instrString) || isSrcNoteLine(instrString) {
+					mnemonic, data = splitSrcDataLine(instrString)
+				} else {
+					mnemonic, op1, op2 = splitSrcCodeLine(instrString)
+					mnemonic = strings.ToUpper(mnemonic)
+
+					op1, unexpected = splitUnexpected(op1, "")
+					if unexpected == "" {
+						op2, unexpected = splitUnexpected(op2, opDlm)
+					}
+
+					op1Type, op1 = splitOp(op1)
+					op2Type, op2 = splitOp(op2)
+				}
+
+				currentSrcLine := srcLine{
+					srcOrigin: origins[lineNum],
+					label:     srcLabel,
+					mnemonic:  mnemonic,
+					op1Type:   op1Type,
+					op1:       op1,
+					op2Type:   op2Type,
+					op2:       op2,
+					data:      data,
+
+					unexpected:    unexpected,
+					stackedLabels: stackedLabels,
+				}
+
+				structSrcLines = append(structSrcLines, currentSrcLine)
+
+				srcLabel = ""
+				stackedLabels = nil
 			}
+		}
+	}
 
-			structSrcLines = append(structSrcLines, currentSrcLine)
+	if srcLabels := asm.getSrcLabels(srcLines, len(srcLines)); len(srcLabels) > 0 {
+		lastLineNum := len(srcLines) - 1
+		for srcLines[lastLineNum] == "" {
+			lastLineNum--
 		}
+
+		structSrcLines = append(structSrcLines, srcLine{
+			srcOrigin:     origins[lastLineNum],
+			label:         srcLabels[len(srcLabels)-1],
+			mnemonic:      endOfSrcMnemonic,
+			stackedLabels: srcLabels[:len(srcLabels)-1],
+		})
 	}
 
 	return structSrcLines
@@ -93,18 +194,81 @@ func buildStructSrc(srcLines []string) []srcLine {
 
 // -----------------------------------------------------------------------------
 
+// splitUnquoted splits a line of source code around each delimiter that is not
+// enclosed in string or character quotes.
+func splitUnquoted(srcLine string, dlm string) []string {
+	var splitLine []string
+
+	quote := ""
+	start := 0
+
+	for i := 0; i < len(srcLine); i++ {
+		if quote != "" && strings.HasPrefix(srcLine[i:], escapeToken) {
+			i++
+		} else if quote != "" {
+			if strings.HasPrefix(srcLine[i:], quote) {
+				quote = ""
+			}
+		} else if isQuoteToken(srcLine[i:]) {
+			quote = srcLine[i : i+1]
+		} else if strings.HasPrefix(srcLine[i:], dlm) {
+			splitLine = append(splitLine, srcLine[start:i])
+			start = i + len(dlm)
+			i += len(dlm) - 1
+		}
+	}
+
+	return append(splitLine, srcLine[start:])
+}
+
+// -----------------------------------------------------------------------------
+
+// indexUnquoted returns the index of the first of any of the given characters
+// in a line of source code that is not enclosed in string or character quotes,
+// or -1 if there is none.
+func indexUnquoted(srcLine string, chars string) int {
+	quote := ""
+
+	for i := 0; i < len(srcLine); i++ {
+		if quote != "" && strings.HasPrefix(srcLine[i:], escapeToken) {
+			i++
+		} else if quote != "" {
+			if strings.HasPrefix(srcLine[i:], quote) {
+				quote = ""
+			}
+		} else if isQuoteToken(srcLine[i:]) {
+			quote = srcLine[i : i+1]
+		} else if strings.ContainsAny(srcLine[i:i+1], chars) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// -----------------------------------------------------------------------------
+
+// isQuoteToken checks whether a part of a line of source code starts with a
+// string or character quote.
+func isQuoteToken(srcLinePart string) bool {
+	return strings.HasPrefix(srcLinePart, srcStringToken) || strings.HasPrefix(srcLinePart, srcCharToken)
+}
+
+// -----------------------------------------------------------------------------
+
 // splitSrcCodeLine breaks down a line of non-data directive source code.
+// Operand delimiters within string or character quotes are ignored.
 func splitSrcCodeLine(srcLine string) (string, string, string) {
 	splitLine := strings.SplitN(srcLine, mnemonicOpDlm, 2)
 
 	if len(splitLine) > 1 {
-		splitOps := strings.SplitN(splitLine[1], opDlm, 2)
+		index := indexUnquoted(splitLine[1], opDlm)
 
-		if len(splitOps) > 1 {
-			return splitLine[0], splitOps[0], splitOps[1]
+		if index >= 0 {
+			return splitLine[0], splitLine[1][:index], splitLine[1][index+len(opDlm):]
 		}
 
-		return splitLine[0], splitOps[0], ""
+		return splitLine[0], splitLine[1], ""
 	}
 
 	return splitLine[0], "", ""
@@ -112,23 +276,80 @@ func splitSrcCodeLine(srcLine string) (string, string, string) {
 
 // -----------------------------------------------------------------------------
 
-// isSrcDataLine checks whether a line of source code is a data directive.
+// splitUnexpected separates an operand from any stray content following it,
+// i.e. anything after unquoted whitespace or one of the given extra delimiters.
+func splitUnexpected(op string, dlms string) (string, string) {
+	cleanOp := strings.TrimSpace(op)
+
+	index := indexUnquoted(cleanOp, " \t"+dlms)
+	if index < 0 {
+		return cleanOp, ""
+	}
+
+	return cleanOp[:index], strings.TrimLeft(cleanOp[index:], " \t"+dlms)
+}
+
+// -----------------------------------------------------------------------------
+
+// firstChar returns the first byte of a line of source code as a string, or an
+// empty string if the line is empty.
+func firstChar(srcLine string) string {
+	if srcLine == "" {
+		return ""
+	}
+
+	return srcLine[:1]
+}
+
+// -----------------------------------------------------------------------------
+
+// isSrcDataLine checks whether a line of source code is a data directive, i.e.
+// starts with a data directive token or an alias of one, in any case. Other
+// tokens starting with the data line token do not make a data directive.
 func isSrcDataLine(srcLine string) bool {
-	return srcLine != "" && srcLine[:1] == dataLineToken
+	if firstChar(srcLine) != dataLineToken {
+		return false
+	}
+
+	token := strings.ToUpper(strings.Fields(srcLine)[0])
+	if _, exists := mnemonicAliases[token]; exists {
+		token = mnemonicAliases[token]
+	}
+
+	for _, directiveToken := range directiveTokens {
+		if token == directiveToken {
+			return true
+		}
+	}
+
+	return false
 }
 
 // -----------------------------------------------------------------------------
 
-// splitSrcCodeLine breaks down a line of source code containing a data
-// directive.
+// isSrcNoteLine checks whether a line of source code is a note directive, whose
+// string is kept as data rather than being parsed as operands.
+func isSrcNoteLine(srcLine string) bool {
+	token := strings.ToUpper(strings.Fields(srcLine)[0])
+	if _, exists := mnemonicAliases[token]; exists {
+		token = mnemonicAliases[token]
+	}
+
+	return token == noteToken
+}
+
+// -----------------------------------------------------------------------------
+
+// splitSrcDataLine breaks down a line of source code containing a data
+// directive. The directive token is uppercased like mnemonics are.
 func splitSrcDataLine(srcLine string) (string, string) {
 	splitLine := strings.SplitN(srcLine, mnemonicOpDlm, 2)
 
 	if len(splitLine) > 1 {
-		return splitLine[0], splitLine[1]
+		return strings.ToUpper(splitLine[0]), splitLine[1]
 	}
 
-	return splitLine[0], ""
+	return strings.ToUpper(splitLine[0]), ""
 }
 
 // -----------------------------------------------------------------------------
@@ -139,7 +360,7 @@ func splitOp(op string) (opType, string) {
 
 	opType := getOpType(cleanOp)
 
-	if opType == literalOp || opType == pointerOp {
+	if opType == literalOp || opType == pointerOp || opType == relativeOp {
 		return opType, cleanOp[1:len(cleanOp)]
 	}
 
@@ -151,12 +372,14 @@ func splitOp(op string) (opType, string) {
 // getOpType determines the type of an operand.
 func getOpType(op string) opType {
 	if op != "" {
-		firstChar := op[:1]
+		opToken := firstChar(op)
 
-		if firstChar == opTokens[literalOp] {
+		if opToken == opTokens[literalOp] {
 			return literalOp
-		} else if firstChar == opTokens[pointerOp] {
+		} else if opToken == opTokens[pointerOp] {
 			return pointerOp
+		} else if opToken == opTokens[relativeOp] {
+			return relativeOp
 		} else {
 			return addressOp
 		}
@@ -167,30 +390,55 @@ func getOpType(op string) opType {
 
 // -----------------------------------------------------------------------------
 
-// getSrcLabel determines the label, if any, of a line of source code.
-func getSrcLabel(srcLines []string, lineNum int) string {
+// getSrcLabels determines the labels, if any, of a line of source code, in
+// the order they are defined. Several labels directly preceding a line share
+// its address.
+func (asm *assembly) getSrcLabels(srcLines []string, lineNum int) []string {
+	var srcLabels []string
+
 	currentLineNum := lineNum - 1
 
 	for currentLineNum >= 0 {
 		if srcLines[currentLineNum] != "" {
-			if isSrcLabel(srcLines[currentLineNum]) {
-				return srcLines[currentLineNum]
-			} else {
-				return ""
+			if !asm.isSrcLabel(srcLines[currentLineNum]) {
+				break
 			}
+
+			srcLabels = append([]string{srcLines[currentLineNum]}, srcLabels...)
 		}
 
 		currentLineNum--
 	}
 
-	return ""
+	return srcLabels
+}
+
+// -----------------------------------------------------------------------------
+
+// getLineLabels returns all labels of a structured source line, in the order
+// they are defined.
+func getLineLabels(srcLine srcLine) []string {
+	if srcLine.label == "" {
+		return nil
+	}
+
+	return append(append([]string{}, srcLine.stackedLabels...), srcLine.label)
 }
 
 // -----------------------------------------------------------------------------
 
 // isSrcLabel checks whether a string is a source label.
-func isSrcLabel(srcLine string) bool {
-	reSrcLabel := regexp.MustCompile(`^[\w.]+$`)
+func (asm *assembly) isSrcLabel(srcLine string) bool {
+	reSrcLabel := regexp.MustCompile(`^` + asm.getSrcLabelPattern() + `$`)
+
+	return reSrcLabel.MatchString(srcLine)
+}
+
+// -----------------------------------------------------------------------------
 
-	return len(srcLine) >= srcLabelMinLen && reSrcLabel.MatchString(srcLine)
+// getSrcLabelPattern returns the regular expression pattern matching a source
+// label of the assembly's minimum length, shared by everything finding labels
+// in source code.
+func (asm *assembly) getSrcLabelPattern() string {
+	return srcLabelChars + `{` + strconv.Itoa(asm.opts.SrcLabelMinLen) + `,}`
 }
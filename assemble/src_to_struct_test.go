@@ -0,0 +1,117 @@
+/*
+Copyright 2018-2019 Juan Irming
+
+This file is part of rasm16.
+
+rasm16 is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+rasm16 is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with rasm16.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package assemble
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// -----------------------------------------------------------------------------
+
+// TestSrcLabelPattern verifies that labels of the minimum length rewritten by
+// namespacing are still found as labels, and that shorter names are not labels,
+// for the default and a longer minimum length.
+func TestSrcLabelPattern(t *testing.T) {
+	for _, minLen := range []int{defaultSrcLabelMinLen, 8} {
+		opts := DefaultOptions()
+		opts.SrcLabelMinLen = minLen
+
+		asm := newAssembly(opts)
+
+		label := strings.Repeat("x", minLen)
+		nsLabel := "selftest" + namespaceDlm + label
+
+		srcLines := asm.addSrcLabelNamespaces([]string{label, "JM $" + label}, "selftest")
+
+		if srcLines[0] != nsLabel || !asm.isSrcLabel(srcLines[0]) || asm.getOpLabel(srcLines[1]) != nsLabel {
+			t.Error("Namespaced label " + label + " not found as label, got \"" + strings.Join(srcLines, "; ") + "\"")
+		}
+
+		if asm.isSrcLabel(label[1:]) {
+			t.Error("Label pattern accepts labels shorter than the minimum length of " + strconv.Itoa(minLen))
+		}
+
+		program := testProgram{
+			srcName: "selftest_labellen.rasm",
+			offset:  0x1000,
+			src:     []string{"    NO", label, "    JM   $" + label},
+			bin:     []byte{0x00, 0xE8, 0x10, 0x01},
+		}
+
+		bin, asm, err := assembleTest(program.src, program.srcName, program.offset, opts)
+		if err == nil {
+			err = checkTestProgram(program, bin, asm.warnings)
+		}
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	opts := DefaultOptions()
+	opts.SrcLabelMinLen = 4
+
+	if validateOptions(opts) == nil {
+		t.Error("Accepted a minimum label length that clashes with 16-bit hexadecimal values")
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// FuzzFirstChar feeds arbitrary lines, including empty ones and lone tokens,
+// through the source processing steps that look at the first character of
+// lines, data values and escape sequences. Errors are expected results, while
+// panics fail.
+func FuzzFirstChar(f *testing.F) {
+	for _, seed := range []string{"", "$", "$8 (", "[", "[A]", "<", "\\", `"`, `$8 "\`, "(", "#redefine ", "label\n"} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, src string) {
+		asm := newAssembly(DefaultOptions())
+
+		srcLines := strings.Split(src, "\n")
+		origins := newSrcOrigins("", srcLines)
+
+		srcLines = asm.cleanSrc(srcLines)
+
+		for _, srcLine := range srcLines {
+			isSrcDataLine(srcLine)
+			asm.isSrcLabel(srcLine)
+		}
+
+		srcLines, err := asm.expandConsts(srcLines, origins, "fuzz")
+		if err != nil {
+			return
+		}
+
+		srcLines = asm.addSrcLabelNamespaces(srcLines, "fuzz")
+
+		structSrcLines := asm.buildStructSrc(srcLines, origins)
+
+		structSrcLines, err = asm.convDataStringsToHex(structSrcLines)
+		if err != nil {
+			return
+		}
+
+		asm.expandDataNullRepeats(structSrcLines)
+	})
+}
@@ -20,7 +20,9 @@ along with rasm16.  If not, see <http://www.gnu.org/licenses/>.
 package assemble
 
 import (
+	"errors"
 	"fmt"
+	"os"
 	"strconv"
 	"strings"
 )
@@ -30,19 +32,45 @@ import (
 // RELIC-16 binary executable file magic header.
 var binMagicHeader []byte = []byte{0x12, 0x31, 0x1C, 0x16} // 0x12311C16 == RELIC16
 
+// Number of bytes per row of hex dumps.
+const hexRowLength int = 8
+
+// RELIC-16 build-info footer magic, always the very last four bytes of a binary
+// carrying a footer.
+var binBuildInfoMagic []byte = []byte{0x12, 0x31, 0x1C, 0xBF} // 0x12311CBF == RELIC Build Footer
+
+// Build-info text, e.g. application name, version and timestamp, appended to
+// the binary as a footer if non-empty.
+//
+// The footer follows everything else in the binary and is laid out as:
+//
+//	[text bytes][16-bit big-endian text length][build-info footer magic]
+//
+// A loader can detect the footer by checking the last four bytes for the
+// magic, then skip the length plus six bytes from the end of the binary.
+var BuildInfo string = ""
+
+// Size in bytes to zero-fill binaries up to, including the header and any
+// build-info footer, or 0 for no padding.
+var PadSize int = 0
+
+// Highest opcode, which takes the upper five bits of an instruction's first
+// byte, followed by the addressing mode.
+const maxOpcode byte = 0x1F
+
 // -----------------------------------------------------------------------------
 
 // buildBinSrcLines constructs the binary instructions from a slice of
 // processed source code.
-func buildBinSrcLines(srcLines []srcLine) []srcLine {
+func (asm *assembly) buildBinSrcLines(srcLines []srcLine) []srcLine {
 	var binSrcLines []srcLine
 
 	for _, srcLine := range srcLines {
 		binSrcLine := srcLine
 
 		if isValidDataDirective(srcLine.mnemonic) {
-			binSrcLine = buildData(binSrcLine)
-		} else {
+			binSrcLine = asm.buildData(binSrcLine)
+		} else if srcLine.mnemonic != bankToken && srcLine.mnemonic != alignToken && srcLine.mnemonic != noteToken && srcLine.mnemonic != endOfSrcMnemonic {
 			binSrcLine = buildInstr(binSrcLine)
 		}
 
@@ -54,13 +82,15 @@ func buildBinSrcLines(srcLines []srcLine) []srcLine {
 
 // -----------------------------------------------------------------------------
 
-// buildData builds out the binary values from a data directive.
-func buildData(srcLine srcLine) srcLine {
+// buildData builds out the binary values from a data directive. Values must
+// have passed validateDataDirectives, which rejects 8-bit values of more than
+// two hexadecimal digits rather than letting them saturate here.
+func (asm *assembly) buildData(srcLine srcLine) srcLine {
 	binSrcLine := srcLine
 
 	var data64 uint64
 
-	splitData := strings.Split(srcLine.data, dataDlm)
+	splitData := asm.splitDataValues(srcLine.data)
 
 	if srcLine.mnemonic == directiveTokens[data8BitDirective] {
 		for _, data := range splitData {
@@ -108,6 +138,8 @@ func buildOpcode(srcLine srcLine) srcLine {
 		opcode |= 0x04
 	} else if srcLine.op1Type == pointerOp && srcLine.op2Type == pointerOp {
 		opcode |= 0x05
+	} else if srcLine.op1Type == relativeOp {
+		opcode |= 0x06
 	}
 
 	opcodeSrcLine.bin = append(opcodeSrcLine.bin, opcode)
@@ -164,13 +196,40 @@ func splitUint16(srcInt uint16) (byte, byte) {
 // -----------------------------------------------------------------------------
 
 // buildBin constructs the final binary executable from the binary data in each
-// structured and processed binary line of source code.
-func buildBin(srcLines []srcLine, programOffset uint16) []byte {
-	bin := binMagicHeader
-	bin = appendUint16(bin, programOffset)
+// structured and processed binary line of source code, using the header format
+// version of the assembly and the given entry point. Banked source code results
+// in one bank header and bank image per bank, following the main header.
+func (asm *assembly) buildBin(srcLines []srcLine, programOffset uint16, entryPoint uint16) ([]byte, error) {
+	bin := buildHeader(asm.opts.HeaderVersion, programOffset, entryPoint)
+
+	if isBanked(srcLines) {
+		bin = append(bin, buildBanks(srcLines)...)
+	} else {
+		for _, srcLine := range srcLines {
+			bin = append(bin, srcLine.bin...)
+		}
+	}
 
-	for _, srcLine := range srcLines {
-		bin = append(bin, srcLine.bin...)
+	return asm.finishBin(bin)
+}
+
+// -----------------------------------------------------------------------------
+
+// buildBanks constructs the bank headers and bank images for banked source
+// code, in the order the banks appear in.
+func buildBanks(srcLines []srcLine) []byte {
+	var bin []byte
+	var bankBin []byte
+
+	for lineNum, srcLine := range srcLines {
+		bankBin = append(bankBin, srcLine.bin...)
+
+		if lineNum == len(srcLines)-1 || srcLines[lineNum+1].bank != srcLine.bank {
+			bin = append(bin, buildBankHeader(byte(srcLine.bank), len(bankBin))...)
+			bin = append(bin, bankBin...)
+
+			bankBin = nil
+		}
 	}
 
 	return bin
@@ -178,22 +237,93 @@ func buildBin(srcLines []srcLine, programOffset uint16) []byte {
 
 // -----------------------------------------------------------------------------
 
-// printBin outputs the final binary for debugging purposes.
-func printBin(message string, bin []byte) {
-	if DEBUG {
-		fmt.Println(message)
+// finishBin zero-fills a binary up to the pad size, if any, and appends the
+// build-info footer, if any. The padding goes before the footer, since the
+// footer must remain the very last part of the binary.
+func (asm *assembly) finishBin(bin []byte) ([]byte, error) {
+	var footer []byte
+	if asm.opts.BuildInfo != "" {
+		footer = appendBuildInfo(nil, asm.opts.BuildInfo)
+	}
+
+	if padSize := asm.opts.PadSize; padSize > 0 {
+		if len(bin)+len(footer) > padSize {
+			return nil, errors.New("Binary size of " + strconv.Itoa(len(bin)+len(footer)) + " bytes exceeds pad size of " + strconv.Itoa(padSize) + " bytes")
+		}
+
+		bin = append(bin, make([]byte, padSize-len(bin)-len(footer))...)
+	}
+
+	return append(bin, footer...), nil
+}
+
+// -----------------------------------------------------------------------------
 
-		x := 0
+// appendBuildInfo appends a build-info footer to a binary, truncating the text
+// to the maximum length a 16-bit length field can describe.
+func appendBuildInfo(bin []byte, buildInfo string) []byte {
+	text := []byte(buildInfo)
+	if len(text) > 0xFFFF {
+		text = text[:0xFFFF]
+	}
+
+	bin = append(bin, text...)
+	bin = appendUint16(bin, uint16(len(text)))
+	bin = append(bin, binBuildInfoMagic...)
+
+	return bin
+}
+
+// -----------------------------------------------------------------------------
+
+// HexDump formats the program of a binary executable as a hex dump, one line
+// per row of bytes, each starting with the row's address based on the program
+// offset in the header.
+func HexDump(bin []byte) ([]string, error) {
+	header, err := ReadHeader(bin)
+	if err != nil {
+		return nil, err
+	}
+
+	var hexDump []string
+
+	for rowNum, row := range formatHexRows(bin[header.Length:]) {
+		address := int(header.ProgramOffset) + rowNum*hexRowLength
+		hexDump = append(hexDump, strings.ToUpper(fmt.Sprintf("%04x", address))+"  "+row)
+	}
+
+	return hexDump, nil
+}
 
-		for _, currentByte := range bin {
-			fmt.Print(strings.ToUpper(fmt.Sprintf("%02x", currentByte)) + " ")
+// -----------------------------------------------------------------------------
+
+// formatHexRows formats bytes as rows of space-separated hexadecimal values.
+func formatHexRows(bin []byte) []string {
+	var rows []string
+
+	for start := 0; start < len(bin); start += hexRowLength {
+		end := start + hexRowLength
+		if end > len(bin) {
+			end = len(bin)
+		}
+
+		rows = append(rows, formatBytes(bin[start:end]))
+	}
+
+	return rows
+}
+
+// -----------------------------------------------------------------------------
+
+// printBin outputs the final binary to standard error for debugging purposes.
+func printBin(message string, bin []byte) {
+	if DEBUG {
+		fmt.Fprintln(os.Stderr, message)
 
-			x++
-			if x%8 == 0 {
-				fmt.Println()
-			}
+		for _, row := range formatHexRows(bin) {
+			fmt.Fprintln(os.Stderr, row)
 		}
 
-		fmt.Println()
+		fmt.Fprintln(os.Stderr)
 	}
 }
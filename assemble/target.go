@@ -0,0 +1,144 @@
+/*
+Copyright 2018-2019 Juan Irming
+
+This file is part of rasm16.
+
+rasm16 is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+rasm16 is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with rasm16.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package assemble
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// -----------------------------------------------------------------------------
+
+// Target memory profile definition.
+type targetProfile struct {
+	descr                string
+	specialAddressConsts map[string]string
+	defaultConsts        map[string]string // Special address and magic value preprocessor constants.
+	maxAddressSpace      int               // Leaving space for call stack below Stack Pointer.
+}
+
+// Target memory profile definitions.
+var targetProfiles = map[string]targetProfile{
+	"relic16":     newTargetProfile("RELIC-16, 64KB", 2*128, specialAddressConsts),
+	"relic16-32k": newTargetProfile("RELIC-16, 32KB", 2*128, relocateConsts(specialAddressConsts, -0x8000)),
+}
+
+// Default target memory profile name.
+const DefaultTargetName string = "relic16"
+
+// Target memory profile to assemble for.
+var Target string = DefaultTargetName
+
+// -----------------------------------------------------------------------------
+
+// newTargetProfile creates a target memory profile, reserving stackSize bytes
+// for the call stack below the Stack Pointer.
+func newTargetProfile(descr string, stackSize int, specialAddressConsts map[string]string) targetProfile {
+	stackPointer, _ := strconv.ParseUint(specialAddressConsts["[SP]"], 16, 16)
+
+	return targetProfile{
+		descr:                descr,
+		specialAddressConsts: specialAddressConsts,
+		defaultConsts:        mergeConsts(specialAddressConsts, magicValueConsts),
+		maxAddressSpace:      int(stackPointer) - stackSize,
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// SelectTarget switches to a target memory profile for subsequent assemblies.
+// Each assembly keeps the profile it started out with.
+func SelectTarget(name string) error {
+	_, err := getTargetProfile(name)
+	if err != nil {
+		return err
+	}
+
+	Target = name
+
+	return nil
+}
+
+// -----------------------------------------------------------------------------
+
+// getTargetProfile looks up a target memory profile by name.
+func getTargetProfile(name string) (targetProfile, error) {
+	profile, exists := targetProfiles[name]
+	if !exists {
+		return profile, errors.New("Unknown target " + name + ", available targets: " + strings.Join(getTargetNames(), ", "))
+	}
+
+	return profile, nil
+}
+
+// -----------------------------------------------------------------------------
+
+// getTargetNames returns the names of all target memory profiles, sorted.
+func getTargetNames() []string {
+	var names []string
+
+	for name := range targetProfiles {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// -----------------------------------------------------------------------------
+
+// getSpecialAddressRange returns the first and last address of the special
+// address region of a target memory profile.
+func (profile targetProfile) getSpecialAddressRange() (int, int) {
+	first, last := 0xFFFF, 0
+
+	for _, constValue := range profile.specialAddressConsts {
+		address, _ := strconv.ParseUint(constValue, 16, 16)
+
+		if int(address) < first {
+			first = int(address)
+		}
+
+		if int(address)+1 > last {
+			last = int(address) + 1
+		}
+	}
+
+	return first, last
+}
+
+// -----------------------------------------------------------------------------
+
+// relocateConsts creates a copy of an address preprocessor constant map with
+// every address moved by the same distance.
+func relocateConsts(consts map[string]string, distance int) map[string]string {
+	relocatedConsts := make(map[string]string)
+
+	for constName, constValue := range consts {
+		address, _ := strconv.ParseUint(constValue, 16, 16)
+		relocatedConsts[constName] = strings.ToUpper(fmt.Sprintf("%04x", uint16(int(address)+distance)))
+	}
+
+	return relocatedConsts
+}
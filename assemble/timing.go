@@ -0,0 +1,73 @@
+/*
+Copyright 2018-2019 Juan Irming
+
+This file is part of rasm16.
+
+rasm16 is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+rasm16 is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with rasm16.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package assemble
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+
+// Whether to print the duration of each assembly phase to standard error.
+var PrintTiming bool = false
+
+// Assembly phase duration definition.
+type phaseTiming struct {
+	phase    string
+	duration time.Duration
+}
+
+// -----------------------------------------------------------------------------
+
+// addTiming adds the time passed since the given start to an assembly phase.
+// Phases run once per source file accumulate, keeping their original order.
+func (asm *assembly) addTiming(phase string, start time.Time) {
+	duration := time.Since(start)
+
+	for i := range asm.timings {
+		if asm.timings[i].phase == phase {
+			asm.timings[i].duration += duration
+
+			return
+		}
+	}
+
+	asm.timings = append(asm.timings, phaseTiming{phase: phase, duration: duration})
+}
+
+// -----------------------------------------------------------------------------
+
+// printTimings outputs the duration of each assembly phase and their total to
+// standard error. Include processing covers the processing of the include
+// files themselves.
+func (asm *assembly) printTimings() {
+	var total time.Duration
+
+	fmt.Fprintln(os.Stderr, "Timing:")
+
+	for _, timing := range asm.timings {
+		fmt.Fprintf(os.Stderr, "%-24s%v\n", timing.phase, timing.duration)
+		total += timing.duration
+	}
+
+	fmt.Fprintf(os.Stderr, "%-24s%v\n", "Total", total)
+}
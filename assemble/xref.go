@@ -0,0 +1,73 @@
+/*
+Copyright 2018-2019 Juan Irming
+
+This file is part of rasm16.
+
+rasm16 is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+rasm16 is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with rasm16.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package assemble
+
+import (
+	"sort"
+	"strings"
+)
+
+// -----------------------------------------------------------------------------
+
+// Whether to build a cross-reference during assembly.
+var BuildXref bool = false
+
+// Cross-reference built during the most recent assembly, one label per element.
+var Xref []string
+
+// -----------------------------------------------------------------------------
+
+// buildXref builds a cross-reference of structured source code with expanded
+// labels, listing every label by its full, namespaced name along with the lines
+// referencing it in operands or data, sorted by label. Lines of include files
+// are prefixed with the include filename, e.g. io._rasm:3.
+func buildXref(srcLines []srcLine) []string {
+	labelRefs := make(map[string][]string)
+
+	for _, srcLine := range srcLines {
+		for _, label := range getLineLabels(srcLine) {
+			labelRefs[label] = nil
+		}
+	}
+
+	for _, srcLine := range srcLines {
+		ref := formatOriginRef(srcLine.srcOrigin)
+
+		for _, label := range srcLine.labelRefs {
+			refs := labelRefs[label]
+			if len(refs) == 0 || refs[len(refs)-1] != ref {
+				labelRefs[label] = append(refs, ref)
+			}
+		}
+	}
+
+	var labels []string
+	for label := range labelRefs {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	var xref []string
+	for _, label := range labels {
+		xref = append(xref, label+"\t"+strings.Join(labelRefs[label], " "))
+	}
+
+	return xref
+}
@@ -0,0 +1,60 @@
+/*
+Copyright 2018-2019 Juan Irming
+
+This file is part of rasm16.
+
+rasm16 is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+rasm16 is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with rasm16.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package assemble
+
+import (
+	"strings"
+	"testing"
+)
+
+// -----------------------------------------------------------------------------
+
+// TestBuildXref builds a cross-reference of a small program and verifies the
+// lines listed for each label, including a label that is never referenced.
+func TestBuildXref(t *testing.T) {
+	src := []string{
+		"start_loop",
+		"    JM   $start_loop",
+		"table_start",
+		"    $16  start_loop,table_end-table_start",
+		"table_end",
+		"    CO   table_start,*table_end",
+		"never_used",
+		"    NO",
+	}
+
+	expected := []string{
+		"selftest_xref.never_used\t",
+		"selftest_xref.start_loop\t2 4",
+		"selftest_xref.table_end\t4 6",
+		"selftest_xref.table_start\t4 6",
+	}
+
+	srcLines, _, _, err := newAssembly(DefaultOptions()).buildValidatedSrc([][]string{src}, []string{"selftest_xref.rasm"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	xref := buildXref(srcLines)
+
+	if strings.Join(xref, "\n") != strings.Join(expected, "\n") {
+		t.Error("Cross-reference mismatch, got \"" + strings.Join(xref, "; ") + "\"")
+	}
+}
@@ -28,11 +28,20 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
 // -----------------------------------------------------------------------------
 
-const DEBUG bool = true
+var DEBUG bool = true
+
+// File mode of written files, before the umask is applied.
+var FileMode os.FileMode = 0666
+
+// Whether the file mode was given explicitly, in which case it is applied
+// regardless of the umask.
+var ExplicitFileMode bool = false
 
 // -----------------------------------------------------------------------------
 
@@ -41,14 +50,22 @@ const (
 	SrcExt string = ".rasm"
 	IncExt string = "._rasm"
 	BinExt string = ".r16"
+	ObjExt string = ".o16"
+	LstExt string = ".lst"
+	XrfExt string = ".xrf"
+	HexExt string = ".hex"
+	RelExt string = ".rel"
 )
 
+// Filename extension appended to temporary files while writing.
+const tmpExt string = ".tmp"
+
 // -----------------------------------------------------------------------------
 
 // ReadSrc reads a source file from disk into a slice, one line per element.
 func ReadSrc(srcName string) ([]string, error) {
 	if DEBUG {
-		fmt.Println("Reading " + srcName)
+		fmt.Fprintln(os.Stderr, "Reading "+srcName)
 	}
 
 	f, err := os.Open(srcName)
@@ -64,25 +81,107 @@ func ReadSrc(srcName string) ([]string, error) {
 		lines = append(lines, scanner.Text())
 	}
 
-	fmt.Println("Read " + srcName)
+	fmt.Fprintln(os.Stderr, "Read "+srcName)
 
 	return lines, scanner.Err()
 }
 
 // -----------------------------------------------------------------------------
 
+// ReadBin reads a binary file from disk into a byte slice.
+func ReadBin(binName string) ([]byte, error) {
+	if DEBUG {
+		fmt.Fprintln(os.Stderr, "Reading "+binName)
+	}
+
+	bin, err := ioutil.ReadFile(binName)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintln(os.Stderr, "Read", len(bin), "bytes from "+binName)
+
+	return bin, nil
+}
+
+// -----------------------------------------------------------------------------
+
 // WriteBin writes a byte slice to disk as a binary file.
 func WriteBin(bin []byte, binName string) error {
 	if DEBUG {
-		fmt.Println("Writing " + binName)
+		fmt.Fprintln(os.Stderr, "Writing "+binName)
 	}
 
-	err := ioutil.WriteFile(binName, bin, 0666)
+	err := writeFile(binName, bin)
 	if err != nil {
 		return err
 	}
 
-	fmt.Println("Wrote", len(bin), "bytes to "+binName)
+	fmt.Fprintln(os.Stderr, "Wrote", len(bin), "bytes to "+binName)
+
+	return nil
+}
+
+// -----------------------------------------------------------------------------
+
+// WriteText writes a string slice to disk as a text file, one line per element.
+func WriteText(lines []string, textName string) error {
+	if DEBUG {
+		fmt.Fprintln(os.Stderr, "Writing "+textName)
+	}
+
+	var text string
+	if len(lines) > 0 {
+		text = strings.Join(lines, "\n") + "\n"
+	}
+
+	err := writeFile(textName, []byte(text))
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(os.Stderr, "Wrote", len(lines), "lines to "+textName)
+
+	return nil
+}
+
+// -----------------------------------------------------------------------------
+
+// writeFile writes data to disk using the configured file mode. The data is
+// written to a uniquely named temporary file next to the target first, which
+// then replaces the target, so that an interrupted write never leaves a partial
+// file behind and concurrent writers never share a temporary file.
+func writeFile(name string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".*"+tmpExt)
+	if err != nil {
+		return err
+	}
+	tmpName := f.Name()
+
+	mode := FileMode
+	if !ExplicitFileMode {
+		mode &^= umask
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpName, mode)
+	}
+	if err == nil {
+		err = os.Rename(tmpName, name)
+	}
+
+	if err != nil {
+		os.Remove(tmpName)
+
+		return err
+	}
 
 	return nil
 }
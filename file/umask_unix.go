@@ -0,0 +1,43 @@
+//go:build unix
+
+/*
+Copyright 2018-2019 Juan Irming
+
+This file is part of rasm16.
+
+rasm16 is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+rasm16 is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with rasm16.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package file
+
+import (
+	"os"
+	"syscall"
+)
+
+// -----------------------------------------------------------------------------
+
+// File mode creation mask of the process, read once at startup since reading it
+// requires briefly changing it.
+var umask os.FileMode = getUmask()
+
+// -----------------------------------------------------------------------------
+
+// getUmask returns the file mode creation mask of the process.
+func getUmask() os.FileMode {
+	mask := syscall.Umask(0)
+	syscall.Umask(mask)
+
+	return os.FileMode(mask)
+}
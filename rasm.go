@@ -25,81 +25,702 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"sort"
 	"github.com/juanirming/rasm16/assemble"
 	"github.com/juanirming/rasm16/file"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // -----------------------------------------------------------------------------
 
 // Basic application information.
 const (
-	appName    string = "rasm16"
-	appVersion string = "1.0.0 alpha"
-	appAuthor  string = "Juan Irming"
+	appName   string = "rasm16"
+	appAuthor string = "Juan Irming"
 )
 
+// Exit status definitions, distinguishing failed assembly, invalid usage and
+// failed file access.
+const (
+	exitOK       int = 0
+	exitAssembly int = 1
+	exitUsage    int = 2
+	exitIO       int = 3
+)
+
+// Interval between checks for changed source files in watch mode.
+const watchInterval time.Duration = 500 * time.Millisecond
+
+// Output options for building a program.
+type buildOptions struct {
+	format     string
+	toStdout   bool
+	splitBanks bool
+	plain      bool
+}
+
+// Include directories given by repeated -I flags.
+type incDirList []string
+
+// String returns the include directories as a flag value.
+func (dirs *incDirList) String() string {
+	return strings.Join(*dirs, ",")
+}
+
+// Set adds an include directory given as a flag value.
+func (dirs *incDirList) Set(dir string) error {
+	*dirs = append(*dirs, dir)
+
+	return nil
+}
+
 // -----------------------------------------------------------------------------
 
 // Main reads a source file, kicks off the assembly process and writes the final
-// binary to disk.
+// binary to disk. Exits with a non-zero status on failure, telling failed
+// assembly, invalid usage and failed file access apart.
 func main() {
+	programOffsetPtr := flag.String("o", "0000", "16-bit program offset, in hex, optionally 0x-prefixed, or in decimal with a # prefix")
+	var incDirs incDirList
+	flag.Var(&incDirs, "I", "directory to search for include files not found next to the including file, may be repeated")
+	maxIncDepthPtr := flag.Int("incdepth", assemble.MaxIncDepth, "maximum include file nesting depth")
+	maxLinesPtr := flag.Int("maxlines", assemble.MaxExpandedLines, "maximum number of source lines after adding include files and expanding null repeats")
+	plainPtr := flag.Bool("plain", false, "print terse error messages without source snippets")
+	commentCharPtr := flag.String("comment", assemble.CommentChar, "comment character, other than # to allow # decimal data values")
+	dataDlmPtr := flag.String("datadlm", assemble.DataDlm, "data directive value delimiter")
+	instrDlmPtr := flag.String("instrdlm", assemble.InstrDlm, "delimiter between instructions sharing a line, other than the comment character")
+	targetPtr := flag.String("target", assemble.DefaultTargetName, "target memory profile")
+	charsetPtr := flag.String("charset", "", "built-in charset name or charset file for $8C directives")
+	replPtr := flag.Bool("repl", false, "assemble lines read from standard input interactively")
+	selfTestPtr := flag.Bool("selftest", false, "assemble an embedded program and verify the result")
+	symbolsPtr := flag.Bool("symbols", false, "print label addresses after a successful build")
+	listOpcodesPtr := flag.Bool("list-opcodes", false, "print all supported mnemonics and exit")
+	listConstsPtr := flag.Bool("list-consts", false, "print all built-in preprocessor constants and exit")
+	checkJumpsPtr := flag.Bool("checkjumps", false, "warn about jump targets outside of the program or on data")
+	warnSharedPtr := flag.Bool("warnshared", false, "warn about labels sharing an address")
+	werrorPtr := flag.Bool("Werror", false, "treat warnings as errors, writing no output if any occur")
+	nsConstsPtr := flag.Bool("nsconsts", false, "namespace preprocessor constants defined in include files")
+	headerVersionPtr := flag.Uint("hdrver", uint(assemble.HeaderVersion), "binary header format version to emit")
+	entryPtr := flag.String("entry", "", "label to record as the entry point in the header, implies the latest header version unless -hdrver is given")
+	splitBanksPtr := flag.Bool("splitbanks", false, "write one binary per bank for banked programs")
+	objectPtr := flag.Bool("c", false, "assemble to a relocatable object file instead of a binary")
+	linkPtr := flag.Bool("link", false, "link the object files given as arguments (without "+file.ObjExt+" extension) into a binary")
+	formatPtr := flag.String("f", "bin", "output format, bin or hexdump")
+	stdoutPtr := flag.Bool("stdout", false, "write text output formats to standard output instead of a file")
+	listingPtr := flag.Bool("listing", false, "write a listing file alongside the binary")
+	xrefPtr := flag.Bool("xref", false, "write a cross-reference file of labels and the lines referencing them alongside the binary")
+	relocPtr := flag.Bool("reloc", false, "write a relocation table file alongside the binary")
+	cyclesPtr := flag.Bool("cycles", false, "include estimated cycle counts in the listing")
+	versionPtr := flag.Bool("version", false, "print the version and exit")
+	padPtr := flag.String("pad", "", "zero-fill the binary up to SIZE bytes, in hex or with a K suffix, e.g. 8000 or 32K")
+	buildInfoPtr := flag.Bool("buildinfo", false, "append a footer with version and build timestamp to the binary")
+	watchPtr := flag.Bool("watch", false, "rebuild whenever the source file or one of its include files changes")
+	modePtr := flag.String("mode", "0666", "octal file mode of written files, applied regardless of the umask if given")
+	structPtr := flag.Bool("struct", false, "print the structured source code with addresses and exit without writing a binary")
+	timingPtr := flag.Bool("timing", false, "print the duration of each assembly phase to standard error")
+	verbosePtr := flag.Bool("v", false, "keep debug output enabled in REPL, watch and structure modes")
+
+	flag.Parse()
+
+	if *versionPtr {
+		fmt.Println(assemble.Version())
+
+		return
+	}
+
 	printAppInfo()
 
-	programOffsetPtr := flag.String("o", "0000", "16-bit hexadecimal program offset")
+	explicitHeaderVersion := false
 
-	flag.Parse()
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "o" {
+			assemble.ExplicitOffset = true
+		}
+
+		if f.Name == "hdrver" {
+			explicitHeaderVersion = true
+		}
+
+		if f.Name == "mode" {
+			file.ExplicitFileMode = true
+		}
+	})
+
+	assemble.MaxIncDepth = *maxIncDepthPtr
+	assemble.MaxExpandedLines = *maxLinesPtr
+	assemble.IncDirs = incDirs
+	assemble.PrintSymbols = *symbolsPtr
+	assemble.NamespaceIncConsts = *nsConstsPtr
+	assemble.CheckJumpTargets = *checkJumpsPtr
+	assemble.WarnSharedLabels = *warnSharedPtr
+	assemble.WarningsAsErrors = *werrorPtr
+	assemble.BuildListing = *listingPtr
+	assemble.BuildXref = *xrefPtr
+	assemble.PrintTiming = *timingPtr
+	assemble.ListCycles = *cyclesPtr
+	assemble.BuildRelocTable = *relocPtr
+
+	if *headerVersionPtr > 0xFF {
+		exitWithError(exitUsage, "Header version must fit in 8 bits")
+	}
+	assemble.HeaderVersion = byte(*headerVersionPtr)
+
+	assemble.EntryLabel = *entryPtr
+	if *entryPtr != "" && !explicitHeaderVersion {
+		assemble.HeaderVersion = assemble.LatestHeaderVersion()
+	}
+
+	if *buildInfoPtr {
+		assemble.BuildInfo = appName + " v" + assemble.Version() + " " + time.Now().UTC().Format(time.RFC3339)
+	}
+
+	if *commentCharPtr == "" {
+		exitWithError(exitUsage, "Comment character cannot be empty")
+	}
+	assemble.CommentChar = *commentCharPtr
+	assemble.DataDlm = *dataDlmPtr
+	assemble.InstrDlm = *instrDlmPtr
+
+	if *formatPtr != "bin" && *formatPtr != "hexdump" {
+		exitWithError(exitUsage, "Unknown output format "+*formatPtr+", use bin or hexdump")
+	}
 
-	programOffset, err := strconv.ParseUint(*programOffsetPtr, 16, 16)
+	err := assemble.SelectTarget(*targetPtr)
 	if err != nil {
-		fmt.Println(err)
+		exitWithError(exitUsage, err)
+	}
+
+	if *charsetPtr != "" {
+		err := assemble.LoadCharset(*charsetPtr)
+		if err != nil {
+			exitWithError(getExitStatus(err), err)
+		}
+	}
+
+	if *padPtr != "" {
+		assemble.PadSize, err = parseSize(*padPtr)
+		if err != nil {
+			exitWithError(exitUsage, err)
+		}
+	}
+
+	fileMode, err := strconv.ParseUint(*modePtr, 8, 9)
+	if err != nil {
+		exitWithError(exitUsage, "Invalid file mode "+*modePtr+", use octal permission bits, e.g. 0644")
+	}
+	file.FileMode = os.FileMode(fileMode)
+
+	programOffset, err := parseOffset(*programOffsetPtr)
+	if err != nil {
+		exitWithError(exitUsage, err)
+	}
+
+	if *listOpcodesPtr {
+		assemble.PrintMnemonics()
+
+		return
+	}
+
+	if *listConstsPtr {
+		assemble.PrintConsts()
+
+		return
+	}
+
+	if *replPtr {
+		assemble.DEBUG = *verbosePtr
+		file.DEBUG = *verbosePtr
+
+		err := assemble.Repl(programOffset)
+		if err != nil {
+			exitWithError(getExitStatus(err), err)
+		}
+
+		return
+	}
+
+	if *selfTestPtr {
+		err := assemble.SelfTest()
+		if err != nil {
+			exitWithError(exitAssembly, "Self-test failed: "+err.Error())
+		}
+
+		fmt.Println("Self-test passed")
+
+		return
+	}
+
+	if *linkPtr {
+		err := linkObjects(flag.Args(), programOffset)
+		if err != nil {
+			exitWithError(getExitStatus(err), err)
+		}
 
 		return
 	}
 
 	srcName, binName, err := getFilenames()
 	if err != nil {
-		fmt.Println(err)
+		exitWithError(exitUsage, err)
+	} else if *objectPtr {
+		err := writeObject(srcName, strings.TrimSuffix(binName, file.BinExt)+file.ObjExt)
+		if err != nil {
+			exitWithError(getExitStatus(err), err)
+		}
 	} else {
+		srcNames := []string{srcName}
+		for _, srcRef := range flag.Args()[1:] {
+			srcNames = append(srcNames, srcRef+file.SrcExt)
+		}
+
+		if *structPtr {
+			assemble.DEBUG = *verbosePtr
+			file.DEBUG = *verbosePtr
+
+			os.Exit(printStructSrc(srcNames, programOffset, *plainPtr))
+		}
+
+		options := buildOptions{format: *formatPtr, toStdout: *stdoutPtr, splitBanks: *splitBanksPtr, plain: *plainPtr}
+
+		if *watchPtr {
+			assemble.DEBUG = *verbosePtr
+			file.DEBUG = *verbosePtr
+
+			watchProgram(srcNames, binName, programOffset, options)
+		} else {
+			_, status := buildProgram(srcNames, binName, programOffset, options)
+			os.Exit(status)
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// buildProgram assembles source files into a binary and writes it to disk,
+// along with any listing, cross-reference or relocation table. Warnings and
+// errors are printed to standard error.
+// Returns the size of the binary and the exit status, exitOK if the build
+// succeeded.
+func buildProgram(srcNames []string, binName string, programOffset uint16, options buildOptions) (int, int) {
+	var rawSrcs [][]string
+
+	for _, srcName := range srcNames {
 		rawSrcLines, err := file.ReadSrc(srcName)
 		if err != nil {
-			fmt.Println(err)
+			fmt.Fprintln(os.Stderr, err)
 
-			return
+			return 0, getExitStatus(err)
 		}
 
-		var bin []byte
+		rawSrcs = append(rawSrcs, rawSrcLines)
+	}
 
-		bin, err = assemble.Raw(rawSrcLines, srcName, uint16(programOffset))
-		if err != nil {
-			fmt.Println(err)
+	rawSrcLines := rawSrcs[0]
 
-			return
+	bin, err := assemble.RawFiles(rawSrcs, srcNames, programOffset)
+
+	for _, warning := range assemble.Warnings {
+		if options.plain {
+			fmt.Fprintln(os.Stderr, warning)
+		} else {
+			printPrettyError(warning, rawSrcLines)
+		}
+	}
+
+	if err != nil {
+		if options.plain {
+			fmt.Fprintln(os.Stderr, err)
+		} else {
+			printPrettyError(err, rawSrcLines)
 		}
 
+		return 0, getExitStatus(err)
+	}
+
+	if options.format == "hexdump" {
+		err = writeHexDump(bin, strings.TrimSuffix(binName, file.BinExt)+file.HexExt, options.toStdout)
+	} else if options.splitBanks {
+		err = writeBanks(bin, binName)
+	} else {
 		err = file.WriteBin(bin, binName)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+
+		return 0, getExitStatus(err)
+	}
+
+	if assemble.BuildListing {
+		err = file.WriteText(assemble.Listing, strings.TrimSuffix(binName, file.BinExt)+file.LstExt)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+
+			return 0, getExitStatus(err)
+		}
+	}
+
+	if assemble.BuildXref {
+		err = file.WriteText(assemble.Xref, strings.TrimSuffix(binName, file.BinExt)+file.XrfExt)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+
+			return 0, getExitStatus(err)
+		}
+	}
+
+	if assemble.BuildRelocTable {
+		err = file.WriteText(assemble.FormatRelocTable(assemble.RelocOffsets), strings.TrimSuffix(binName, file.BinExt)+file.RelExt)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+
+			return 0, getExitStatus(err)
+		}
+	}
+
+	return len(bin), exitOK
+}
+
+// -----------------------------------------------------------------------------
+
+// printStructSrc prints the structured source code of source files with
+// addresses, without assembling a binary. Warnings and errors are printed to
+// standard error. Returns the exit status.
+func printStructSrc(srcNames []string, programOffset uint16, plain bool) int {
+	var rawSrcs [][]string
+
+	for _, srcName := range srcNames {
+		rawSrcLines, err := file.ReadSrc(srcName)
 		if err != nil {
-			fmt.Println(err)
+			fmt.Fprintln(os.Stderr, err)
+
+			return getExitStatus(err)
+		}
+
+		rawSrcs = append(rawSrcs, rawSrcLines)
+	}
+
+	structSrc, err := assemble.StructSrc(rawSrcs, srcNames, programOffset)
+
+	for _, warning := range assemble.Warnings {
+		if plain {
+			fmt.Fprintln(os.Stderr, warning)
+		} else {
+			printPrettyError(warning, rawSrcs[0])
+		}
+	}
+
+	if err != nil {
+		if plain {
+			fmt.Fprintln(os.Stderr, err)
+		} else {
+			printPrettyError(err, rawSrcs[0])
+		}
+
+		return getExitStatus(err)
+	}
+
+	for _, line := range structSrc {
+		fmt.Println(line)
+	}
+
+	return exitOK
+}
+
+// -----------------------------------------------------------------------------
+
+// watchProgram builds a program, then keeps watching its source files and the
+// include files they pulled in, rebuilding whenever one of them changes. Never
+// returns.
+func watchProgram(srcNames []string, binName string, programOffset uint16, options buildOptions) {
+	modTimes := make(map[string]time.Time)
+
+	for {
+		fmt.Fprintln(os.Stderr, "Building "+binName+" at "+time.Now().Format("15:04:05"))
+
+		size, status := buildProgram(srcNames, binName, programOffset, options)
+		if status == exitOK {
+			fmt.Fprintln(os.Stderr, "Built "+binName+", "+strconv.Itoa(size)+" bytes")
+		}
+
+		for _, watchName := range append(append([]string{}, srcNames...), assemble.IncNames...) {
+			modTimes[watchName] = getModTime(watchName)
+		}
+
+		fmt.Fprintln(os.Stderr, "Watching "+strconv.Itoa(len(modTimes))+" files for changes")
+
+		for !hasChanged(modTimes) {
+			time.Sleep(watchInterval)
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// getModTime returns the modification time of a file, or the zero time if it
+// cannot be determined, e.g. because the file does not exist (yet).
+func getModTime(name string) time.Time {
+	info, err := os.Stat(name)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return info.ModTime()
+}
+
+// -----------------------------------------------------------------------------
+
+// hasChanged checks whether any of the watched files was modified, created or
+// removed since its modification time was recorded.
+func hasChanged(modTimes map[string]time.Time) bool {
+	for name, modTime := range modTimes {
+		if !getModTime(name).Equal(modTime) {
+			return true
 		}
 	}
+
+	return false
 }
 
 // -----------------------------------------------------------------------------
 
 // printAppInfo outputs basic application information.
 func printAppInfo() {
-	fmt.Println(appName + " v" + appVersion + " by " + appAuthor)
+	fmt.Fprintln(os.Stderr, appName+" v"+assemble.Version()+" by "+appAuthor)
+}
+
+// -----------------------------------------------------------------------------
+
+// writeObject assembles a source file to a relocatable object file.
+func writeObject(srcName string, objName string) error {
+	rawSrcLines, err := file.ReadSrc(srcName)
+	if err != nil {
+		return err
+	}
+
+	object, err := assemble.RawObject(rawSrcLines, srcName)
+	if err != nil {
+		return err
+	}
+
+	data, err := assemble.EncodeObject(object)
+	if err != nil {
+		return err
+	}
+
+	return file.WriteBin(data, objName)
+}
+
+// -----------------------------------------------------------------------------
+
+// linkObjects links object files into a binary named after the first one.
+func linkObjects(objRefs []string, programOffset uint16) error {
+	if len(objRefs) == 0 {
+		return errors.New("Need object filenames (without " + file.ObjExt + " extension) as arguments")
+	}
+
+	var objects []assemble.Object
+
+	for _, objRef := range objRefs {
+		data, err := file.ReadBin(objRef + file.ObjExt)
+		if err != nil {
+			return err
+		}
+
+		object, err := assemble.DecodeObject(data)
+		if err != nil {
+			return errors.New(objRef + file.ObjExt + ": " + err.Error())
+		}
+
+		objects = append(objects, object)
+	}
+
+	bin, err := assemble.Link(objects, programOffset)
+	if err != nil {
+		return err
+	}
+
+	return file.WriteBin(bin, objRefs[0]+file.BinExt)
+}
+
+// -----------------------------------------------------------------------------
+
+// writeHexDump writes a hex dump of a binary to a text file, or to standard
+// output.
+func writeHexDump(bin []byte, hexName string, toStdout bool) error {
+	hexDump, err := assemble.HexDump(bin)
+	if err != nil {
+		return err
+	}
+
+	if toStdout {
+		for _, line := range hexDump {
+			fmt.Println(line)
+		}
+
+		return nil
+	}
+
+	return file.WriteText(hexDump, hexName)
+}
+
+// -----------------------------------------------------------------------------
+
+// writeBanks writes one binary per bank to disk, naming each after the output
+// filename and its hexadecimal bank number, e.g. program.01.r16.
+func writeBanks(bin []byte, binName string) error {
+	banks, err := assemble.SplitBanks(bin)
+	if err != nil {
+		return err
+	}
+
+	var bankNums []int
+
+	for bank := range banks {
+		bankNums = append(bankNums, int(bank))
+	}
+
+	sort.Ints(bankNums)
+
+	for _, bankNum := range bankNums {
+		bank, bankBin := byte(bankNum), banks[byte(bankNum)]
+		bankName := strings.TrimSuffix(binName, file.BinExt) + "." + strings.ToUpper(fmt.Sprintf("%02x", bank)) + file.BinExt
+
+		err = file.WriteBin(bankBin, bankName)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// -----------------------------------------------------------------------------
+
+// printPrettyError outputs an error followed by the offending line of source
+// code and a caret under the problem column, where known, to standard error.
+// Several errors are output one after another.
+func printPrettyError(err error, rawSrcLines []string) {
+	if asmErrs, ok := err.(assemble.AssembleErrors); ok {
+		for _, asmErr := range asmErrs {
+			printPrettyError(asmErr, rawSrcLines)
+		}
+
+		return
+	}
+
+	fmt.Fprintln(os.Stderr, err)
+
+	asmErr, ok := err.(assemble.AssembleError)
+	if !ok {
+		return
+	}
+
+	if asmErr.IncName != "" {
+		rawSrcLines, err = file.ReadSrc(asmErr.IncName)
+		if err != nil {
+			return
+		}
+	}
+
+	if asmErr.LineNum < 1 || asmErr.LineNum > len(rawSrcLines) {
+		return
+	}
+
+	rawSrcLine := rawSrcLines[asmErr.LineNum-1]
+
+	fmt.Fprintln(os.Stderr, rawSrcLine)
+
+	if asmErr.Column > 0 && asmErr.Column <= len(rawSrcLine) {
+		caretIndent := strings.Map(func(r rune) rune {
+			if r == '\t' {
+				return r
+			}
+
+			return ' '
+		}, rawSrcLine[:asmErr.Column-1])
+
+		fmt.Fprintln(os.Stderr, caretIndent+"^")
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// parseSize parses a size given in hexadecimal bytes or in decimal kilobytes
+// with a K suffix, e.g. 8000 or 32K.
+func parseSize(size string) (int, error) {
+	if strings.HasSuffix(strings.ToUpper(size), "K") {
+		kilobytes, err := strconv.ParseUint(size[:len(size)-1], 10, 16)
+		if err != nil {
+			return 0, errors.New("Invalid size " + size)
+		}
+
+		return int(kilobytes) * 1024, nil
+	}
+
+	bytes, err := strconv.ParseUint(size, 16, 32)
+	if err != nil {
+		return 0, errors.New("Invalid size " + size)
+	}
+
+	return int(bytes), nil
+}
+
+// -----------------------------------------------------------------------------
+
+// parseOffset parses a 16-bit program offset given in hexadecimal, optionally
+// with a 0x prefix, or in decimal with a # prefix, e.g. 1000, 0x1000 or #4096.
+func parseOffset(offset string) (uint16, error) {
+	digits, base := offset, 16
+
+	if strings.HasPrefix(offset, "#") {
+		digits, base = offset[1:], 10
+	} else if strings.HasPrefix(strings.ToLower(offset), "0x") {
+		digits = offset[2:]
+	}
+
+	value, err := strconv.ParseUint(digits, base, 16)
+	if err != nil {
+		return 0, errors.New("Invalid program offset " + offset + ", use a 16-bit value like 1000, 0x1000 or #4096")
+	}
+
+	return uint16(value), nil
+}
+
+// -----------------------------------------------------------------------------
+
+// exitWithError outputs an error to standard error and exits with the given
+// status.
+func exitWithError(status int, err interface{}) {
+	fmt.Fprintln(os.Stderr, err)
+
+	os.Exit(status)
+}
+
+// -----------------------------------------------------------------------------
+
+// getExitStatus determines the exit status for an error, exitIO for failed
+// file access and exitAssembly for anything else.
+func getExitStatus(err error) int {
+	switch err.(type) {
+	case *os.PathError, *os.LinkError, *os.SyscallError:
+		return exitIO
+	}
+
+	return exitAssembly
 }
 
 // -----------------------------------------------------------------------------
 
 // getFilenames returns the input- and output filenames based on the first
-// command line argument passed into rasm.
+// command line argument passed into rasm. Any further arguments name additional
+// source files assembled along with the first one.
 func getFilenames() (string, string, error) {
 	var srcName string
 	var binName string
 
-	if len(os.Args) > 1 {
+	if len(flag.Args()) > 0 {
 		srcName = flag.Args()[0] + file.SrcExt
 		binName = flag.Args()[0] + file.BinExt
 	} else {
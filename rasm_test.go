@@ -0,0 +1,110 @@
+/*
+Copyright 2018-2019 Juan Irming
+
+This file is part of rasm16.
+
+rasm16 is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+rasm16 is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with rasm16.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"testing"
+)
+
+// -----------------------------------------------------------------------------
+
+// TestParseSize parses sizes in hexadecimal bytes and in decimal kilobytes, and
+// verifies that invalid and out-of-range sizes are rejected.
+func TestParseSize(t *testing.T) {
+	sizes := []struct {
+		size  string
+		bytes int
+		err   string
+	}{
+		{"8000", 0x8000, ""},
+		{"ff", 0xFF, ""},
+		{"FFFFFFFF", 0xFFFFFFFF, ""},
+		{"32K", 32 * 1024, ""},
+		{"64k", 64 * 1024, ""},
+		{"100000000", 0, "Invalid size 100000000"},
+		{"65536K", 0, "Invalid size 65536K"},
+		{"1AK", 0, "Invalid size 1AK"},
+		{"12G4", 0, "Invalid size 12G4"},
+		{"-1", 0, "Invalid size -1"},
+		{"", 0, "Invalid size "},
+	}
+
+	for _, size := range sizes {
+		bytes, err := parseSize(size.size)
+
+		if size.err != "" {
+			if err == nil || err.Error() != size.err {
+				t.Errorf("Size %s error mismatch, expected \"%s\", got \"%v\"", size.size, size.err, err)
+			}
+
+			continue
+		}
+
+		if err != nil || bytes != size.bytes {
+			t.Errorf("Size %s mismatch, expected %d, got %d (%v)", size.size, size.bytes, bytes, err)
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// TestParseOffset parses program offsets in hexadecimal, with and without a 0x
+// prefix, and in decimal, and verifies that invalid and out-of-range offsets are
+// rejected.
+func TestParseOffset(t *testing.T) {
+	offsets := []struct {
+		offset string
+		value  uint16
+		valid  bool
+	}{
+		{"1000", 0x1000, true},
+		{"ffff", 0xFFFF, true},
+		{"0x1000", 0x1000, true},
+		{"0XfE00", 0xFE00, true},
+		{"#4096", 0x1000, true},
+		{"#65535", 0xFFFF, true},
+		{"#0", 0, true},
+		{"10000", 0, false},
+		{"0x10000", 0, false},
+		{"#65536", 0, false},
+		{"#1A", 0, false},
+		{"12G4", 0, false},
+		{"-1", 0, false},
+		{"0x", 0, false},
+		{"#", 0, false},
+	}
+
+	for _, offset := range offsets {
+		value, err := parseOffset(offset.offset)
+
+		if !offset.valid {
+			expected := "Invalid program offset " + offset.offset + ", use a 16-bit value like 1000, 0x1000 or #4096"
+			if err == nil || err.Error() != expected {
+				t.Errorf("Offset %s error mismatch, expected \"%s\", got \"%v\"", offset.offset, expected, err)
+			}
+
+			continue
+		}
+
+		if err != nil || value != offset.value {
+			t.Errorf("Offset %s mismatch, expected %04X, got %04X (%v)", offset.offset, offset.value, value, err)
+		}
+	}
+}